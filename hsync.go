@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/golang/glog"
 
@@ -16,8 +17,26 @@ var hostName = flag.String("h", "", "host name in client config file, default is
 var showVersion = flag.Bool("version", false, "show version:"+hsync.GetVersion())
 var demoConf = flag.String("demo_conf", "", "show default conf [client|server]")
 var deployOnly = flag.Bool("deploy", false, "deploy all files for server")
+var rollback = flag.String("rollback", "", "switch the current of the release deploy whose to or from is it back to the previous release")
+var deployDryRun bool
+var deployScopes stringList
+
+// stringList a flag which can be given many times
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
 
 func init() {
+	flag.BoolVar(&deployDryRun, "n", false, "with -deploy or -rollback, print the planned actions without changing files")
+	flag.BoolVar(&deployDryRun, "dry-run", false, "same as -n")
+	flag.Var(&deployScopes, "only", "with -deploy, only deploy this path under home, or the deploy entry whose from or to is it, can be given many times")
 	flag.Lookup("alsologtostderr").DefValue = "true"
 	flag.Set("alsologtostderr", "true")
 
@@ -52,22 +71,41 @@ func parserFlags() {
 		fmt.Println(hsync.DemoConf(*demoConf))
 		os.Exit(0)
 	}
-	if *deployOnly {
+	if *deployOnly || *rollback != "" {
 		*asDaemon = true
 	}
 }
 
 func startServer(confName string) {
+	if *deployOnly || *rollback != "" {
+		deployServer(confName)
+		return
+	}
 	server, err := hsync.NewHSyncServer(confName)
 	if err != nil {
 		glog.Exitln("start server failed:", err)
 	}
+	glog.Exitln("server exit:", server.Start())
+}
 
-	if *deployOnly {
-		server.DeployAll()
+// deployServer runs -deploy or -rollback without starting the server
+func deployServer(confName string) {
+	server, err := hsync.NewDeployServer(confName)
+	if err != nil {
+		glog.Exitln("load server failed:", err)
+	}
+	if *rollback != "" {
+		if err = server.Rollback(*rollback, hsync.DeployOptions{DryRun: deployDryRun, Out: os.Stdout}); err != nil {
+			glog.Exitln("rollback failed:", err)
+		}
 		return
 	}
-	glog.Exitln("server exit:", server.Start())
+	summary := server.DeployAll(hsync.DeployOptions{DryRun: deployDryRun, Out: os.Stdout, Only: deployScopes})
+	fmt.Fprintln(os.Stderr, "deploy done:", summary.String())
+	if summary.Failed.Load() > 0 {
+		glog.Flush()
+		os.Exit(1)
+	}
 }
 
 func startClient(confName string) {
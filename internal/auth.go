@@ -0,0 +1,391 @@
+package internal
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	authNonceTTL   = 30 * time.Second
+	authSessionTTL = 10 * time.Minute
+	authTimeSkew   = 5 * time.Minute
+	authSeqWindow  = 4096
+)
+
+// errSessionExpired is matched by message on the client side,
+// net/rpc only carries the error string
+var errSessionExpired = errors.New("auth session expired")
+
+func isSessionExpired(err error) bool {
+	return err != nil && strings.Contains(err.Error(), errSessionExpired.Error())
+}
+
+// authKey derives the HMAC key from a token, the token itself never goes on the wire
+func authKey(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+}
+
+func authMac(key []byte, parts ...string) string {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(strings.Join(parts, "|")))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func authRandom() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic("read random failed: " + err.Error())
+	}
+	return hex.EncodeToString(buf)
+}
+
+// AuthChallenge the server nonce of a login handshake
+type AuthChallenge struct {
+	Nonce string
+}
+
+// AuthLogin proves the client knows the token
+type AuthLogin struct {
+	Nonce       string
+	ClientNonce string
+	Mac         string
+}
+
+// AuthSession the short-lived credential returned by Trans.Login,
+// the session key is derived on both sides and never sent
+type AuthSession struct {
+	ID  string
+	TTL time.Duration
+}
+
+func authLoginMac(key []byte, nonce string, clientNonce string) string {
+	return authMac(key, "login", nonce, clientNonce)
+}
+
+func authSessionKey(key []byte, nonce string, clientNonce string) []byte {
+	k, _ := hex.DecodeString(authMac(key, "session", nonce, clientNonce))
+	return k
+}
+
+// signEncoder writes the fields of a signed request, each one is length-prefixed
+// so that different values never encode to the same bytes
+type signEncoder struct {
+	w   io.Writer
+	buf [binary.MaxVarintLen64]byte
+}
+
+func (e *signEncoder) bytes(b []byte) {
+	e.int(int64(len(b)))
+	e.w.Write(b)
+}
+
+func (e *signEncoder) str(s string) {
+	e.int(int64(len(s)))
+	io.WriteString(e.w, s)
+}
+
+func (e *signEncoder) int(v int64) {
+	e.w.Write(e.buf[:binary.PutVarint(e.buf[:], v)])
+}
+
+func (e *signEncoder) bool(b bool) {
+	if b {
+		e.int(1)
+	} else {
+		e.int(0)
+	}
+}
+
+func (e *signEncoder) time(t time.Time) {
+	e.int(t.Unix())
+	e.int(int64(t.Nanosecond()))
+}
+
+// writeSign writes the RPC method and every field of arg but Sign, which are covered by Sign
+func (arg *RpcArgs) writeSign(w io.Writer, method string) {
+	e := &signEncoder{w: w}
+	e.str(method)
+	e.str(arg.Session)
+	e.int(arg.Time)
+	e.int(int64(arg.Seq))
+	e.str(arg.FileName)
+	e.str(arg.Compare)
+	e.bool(arg.MyFile != nil)
+	if f := arg.MyFile; f != nil {
+		e.str(f.Name)
+		e.bytes(f.Data)
+		e.bool(f.Gzip)
+		e.int(f.Total)
+		e.int(f.Index)
+		e.int(f.Pos)
+		e.str(f.UploadID)
+		e.str(f.Md5)
+		e.bool(f.Stat != nil)
+		if st := f.Stat; st != nil {
+			e.time(st.Mtime)
+			e.int(st.Size)
+			e.str(st.Md5)
+			e.int(int64(st.FileMode))
+			e.bool(st.Exists)
+			e.str(st.Link)
+			e.str(st.Sample)
+		}
+	}
+	e.int(int64(len(arg.Delta)))
+	for _, op := range arg.Delta {
+		e.int(op.Offset)
+		e.int(op.Len)
+		e.bytes(op.Data)
+	}
+	e.bytes(arg.Manifest)
+	e.int(int64(len(arg.Batch)))
+	for _, op := range arg.Batch {
+		e.str(op.Op)
+		e.str(op.Name)
+		e.str(op.From)
+		e.int(int64(op.Mode))
+		e.time(op.Mtime)
+		e.bytes(op.Data)
+		e.str(op.Link)
+		e.str(op.Md5)
+	}
+}
+
+// authSign the sign of the call of method with arg
+func authSign(key []byte, method string, arg *RpcArgs) string {
+	h := hmac.New(sha256.New, key)
+	arg.writeSign(h, method)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// authBodyMac the hash of a request body streamed after the request signed by sign,
+// the body is covered by the sum of it
+func authBodyMac(key []byte, sign string) hash.Hash {
+	h := hmac.New(sha256.New, key)
+	(&signEncoder{w: h}).str(sign)
+	return h
+}
+
+type authSessionState struct {
+	user   *ServerConfUser
+	key    []byte
+	expire time.Time
+	maxSeq uint64
+	seen   map[uint64]struct{}
+}
+
+// checkSeq rejects sequence numbers already used or too old,
+// concurrent calls may arrive a little out of order
+func (st *authSessionState) checkSeq(seq uint64) error {
+	if seq == 0 || seq+authSeqWindow <= st.maxSeq {
+		return fmt.Errorf("seq %d is too old", seq)
+	}
+	if _, has := st.seen[seq]; has {
+		return fmt.Errorf("seq %d replayed", seq)
+	}
+	st.seen[seq] = struct{}{}
+	if seq > st.maxSeq {
+		st.maxSeq = seq
+	}
+	if len(st.seen) > 2*authSeqWindow {
+		for s := range st.seen {
+			if s+authSeqWindow <= st.maxSeq {
+				delete(st.seen, s)
+			}
+		}
+	}
+	return nil
+}
+
+type serverAuth struct {
+	nonces   map[string]time.Time
+	sessions map[string]*authSessionState
+	mu       sync.Mutex
+}
+
+func newServerAuth() *serverAuth {
+	return &serverAuth{
+		nonces:   make(map[string]time.Time),
+		sessions: make(map[string]*authSessionState),
+	}
+}
+
+func (sa *serverAuth) gc(now time.Time) {
+	for nonce, expire := range sa.nonces {
+		if now.After(expire) {
+			delete(sa.nonces, nonce)
+		}
+	}
+	for id, st := range sa.sessions {
+		if now.After(st.expire) {
+			delete(sa.sessions, id)
+		}
+	}
+}
+
+func (sa *serverAuth) challenge() *AuthChallenge {
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+	now := time.Now()
+	sa.gc(now)
+	nonce := authRandom()
+	sa.nonces[nonce] = now.Add(authNonceTTL)
+	return &AuthChallenge{Nonce: nonce}
+}
+
+// login finds the user whose token matches the mac
+func (sa *serverAuth) login(users []*ServerConfUser, arg *AuthLogin) (*ServerConfUser, *AuthSession, error) {
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+	now := time.Now()
+	sa.gc(now)
+	if _, has := sa.nonces[arg.Nonce]; !has {
+		return nil, nil, errors.New("unknown or expired nonce")
+	}
+	// nonce is one-time
+	delete(sa.nonces, arg.Nonce)
+	var user *ServerConfUser
+	for _, u := range users {
+		if arg.ClientNonce != "" && hmac.Equal([]byte(arg.Mac), []byte(authLoginMac(u.key, arg.Nonce, arg.ClientNonce))) {
+			user = u
+			break
+		}
+	}
+	if user == nil {
+		return nil, nil, errors.New("token not match")
+	}
+	session := &AuthSession{
+		ID:  authRandom(),
+		TTL: authSessionTTL,
+	}
+	sa.sessions[session.ID] = &authSessionState{
+		user:   user,
+		key:    authSessionKey(user.key, arg.Nonce, arg.ClientNonce),
+		expire: now.Add(session.TTL),
+		seen:   make(map[uint64]struct{}),
+	}
+	return user, session, nil
+}
+
+// verify checks the session credential of the call of method with arg and returns the session user
+func (sa *serverAuth) verify(method string, arg *RpcArgs) (*ServerConfUser, error) {
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+	now := time.Now()
+	st := sa.sessions[arg.Session]
+	if st == nil || now.After(st.expire) {
+		return nil, errSessionExpired
+	}
+	sent := time.Unix(0, arg.Time)
+	if sent.Before(now.Add(-authTimeSkew)) || sent.After(now.Add(authTimeSkew)) {
+		return nil, fmt.Errorf("request time %s out of range", sent.Format(time.DateTime))
+	}
+	if !hmac.Equal([]byte(arg.Sign), []byte(authSign(st.key, method, arg))) {
+		return nil, errors.New("sign not match")
+	}
+	if err := st.checkSeq(arg.Seq); err != nil {
+		return nil, err
+	}
+	return st.user, nil
+}
+
+// bodyMac returns the hash of the body streamed after the verified request arg
+func (sa *serverAuth) bodyMac(arg *RpcArgs) (hash.Hash, error) {
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+	st := sa.sessions[arg.Session]
+	if st == nil {
+		return nil, errSessionExpired
+	}
+	return authBodyMac(st.key, arg.Sign), nil
+}
+
+// clientAuth holds the session of HSyncClient
+type clientAuth struct {
+	id     string
+	key    []byte
+	expire time.Time
+	seq    uint64
+	mu     sync.Mutex
+
+	loginMu sync.Mutex
+}
+
+func (ca *clientAuth) valid() bool {
+	return ca.id != "" && time.Until(ca.expire) > time.Minute
+}
+
+func (ca *clientAuth) reset() {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	ca.id = ""
+}
+
+func (ca *clientAuth) sign(method string, arg *RpcArgs) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	ca.seq++
+	arg.Session = ca.id
+	arg.Time = time.Now().UnixNano()
+	arg.Seq = ca.seq
+	arg.Sign = authSign(ca.key, method, arg)
+}
+
+// bodyMac returns the hash of the body streamed after the request arg signed by sign
+func (ca *clientAuth) bodyMac(arg *RpcArgs) hash.Hash {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	return authBodyMac(ca.key, arg.Sign)
+}
+
+// ensure logins when there is no valid session, concurrent callers share one login
+func (ca *clientAuth) ensure(token string, call func(method string, args any, reply any) error) error {
+	ca.loginMu.Lock()
+	defer ca.loginMu.Unlock()
+	ca.mu.Lock()
+	valid := ca.valid()
+	ca.mu.Unlock()
+	if valid {
+		return nil
+	}
+	return ca.login(token, call)
+}
+
+// login runs the handshake with call, which must not sign the args itself
+func (ca *clientAuth) login(token string, call func(method string, args any, reply any) error) error {
+	var ch *AuthChallenge
+	if err := call("Trans.Hello", version, &ch); err != nil {
+		return err
+	}
+	key := authKey(token)
+	arg := &AuthLogin{
+		Nonce:       ch.Nonce,
+		ClientNonce: authRandom(),
+	}
+	arg.Mac = authLoginMac(key, arg.Nonce, arg.ClientNonce)
+	var session *AuthSession
+	if err := call("Trans.Login", arg, &session); err != nil {
+		return err
+	}
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	ca.id = session.ID
+	ca.key = authSessionKey(key, arg.Nonce, arg.ClientNonce)
+	ca.expire = time.Now().Add(session.TTL)
+	ca.seq = 0
+	glog.Infoln("auth login success, session expire at", ca.expire.Format(time.DateTime))
+	return nil
+}
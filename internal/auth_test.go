@@ -0,0 +1,79 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerAuth(t *testing.T) {
+	sa := newServerAuth()
+	users := []*ServerConfUser{
+		{Name: "default", key: authKey("token")},
+		{Name: "u1", key: authKey("token1")},
+	}
+	call := func(method string, args any, reply any) error {
+		switch method {
+		case "Trans.Hello":
+			*reply.(**AuthChallenge) = sa.challenge()
+		case "Trans.Login":
+			_, s, err := sa.login(users, args.(*AuthLogin))
+			if err != nil {
+				return err
+			}
+			*reply.(**AuthSession) = s
+		}
+		return nil
+	}
+
+	var bad clientAuth
+	require.Error(t, bad.login("wrong", call))
+
+	var ca clientAuth
+	require.NoError(t, ca.login("token", call))
+	require.True(t, ca.valid())
+
+	arg := &RpcArgs{FileName: "a.txt", MyFile: &MyFile{Name: "a.txt", Data: []byte("hello")}}
+	ca.sign("Trans.CopyFile", arg)
+	user, err := sa.verify("Trans.CopyFile", arg)
+	require.NoError(t, err)
+	require.Equal(t, "default", user.Name)
+	// replay
+	_, err = sa.verify("Trans.CopyFile", arg)
+	require.Error(t, err)
+
+	arg2 := &RpcArgs{FileName: "b.txt", MyFile: &MyFile{Name: "b.txt", Data: []byte("hello")}}
+	ca.sign("Trans.CopyFile", arg2)
+	arg2.MyFile.Data = []byte("changed")
+	_, err = sa.verify("Trans.CopyFile", arg2)
+	require.Error(t, err)
+
+	// a call signed for another method or with a chunk field changed
+	arg5 := &RpcArgs{FileName: "e.txt"}
+	ca.sign("Trans.FileStat", arg5)
+	_, err = sa.verify("Trans.DeleteFile", arg5)
+	require.Error(t, err)
+	arg6 := &RpcArgs{FileName: "f.txt", MyFile: &MyFile{Name: "f.txt", Index: 1, Total: 3}}
+	ca.sign("Trans.CopyFile", arg6)
+	arg6.MyFile.Index = 2
+	_, err = sa.verify("Trans.CopyFile", arg6)
+	require.Error(t, err)
+
+	// the fields are length-prefixed, moving bytes between them changes the sign
+	key := authKey("k")
+	require.NotEqual(t,
+		authSign(key, "m", &RpcArgs{FileName: "a|b", Compare: ""}),
+		authSign(key, "m", &RpcArgs{FileName: "a", Compare: "|b"}))
+
+	arg3 := &RpcArgs{FileName: "c.txt", Session: "unknown"}
+	_, err = sa.verify("Trans.FileStat", arg3)
+	require.True(t, isSessionExpired(err))
+
+	var ca1 clientAuth
+	require.NoError(t, ca1.login("token1", call))
+	arg4 := &RpcArgs{FileName: "d.txt"}
+	ca1.sign("Trans.FileStat", arg4)
+	user, err = sa.verify("Trans.FileStat", arg4)
+	require.NoError(t, err)
+	require.Equal(t, "u1", user.Name)
+}
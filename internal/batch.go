@@ -0,0 +1,235 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// the op types of BatchOp
+const (
+	batchOpCreate = "create"
+	batchOpUpdate = "update"
+	batchOpDelete = "delete"
+	batchOpRename = "rename"
+	batchOpMkdir  = "mkdir"
+
+	// batchOpSymlink makes Name a symlink to Link
+	batchOpSymlink = "symlink"
+)
+
+const (
+	// batchMaxSize the max bytes of inline data in one Trans.Batch call
+	batchMaxSize = TransMaxLength
+
+	// batchMaxOps the max ops in one Trans.Batch call
+	batchMaxOps = 1000
+
+	// batchMaxFileSize files larger than it are sent alone by RemoteSaveFile
+	batchMaxFileSize = 1 << 20
+)
+
+// BatchOp one file operation of Trans.Batch.
+// create and update both replace Name with the gzipped Data,
+// rename moves From to Name.
+type BatchOp struct {
+	Op    string
+	Name  string
+	From  string
+	Mode  os.FileMode
+	Mtime time.Time
+	Data  []byte
+	Link  string
+
+	// Md5 of the raw data, before gzip
+	Md5 string
+}
+
+// BatchOpResult the result of the BatchOp at the same index, Err is empty on success
+type BatchOpResult struct {
+	Name string
+	Err  string
+}
+
+// BatchResult the results of all ops of one Trans.Batch call
+type BatchResult struct {
+	Results []*BatchOpResult
+}
+
+func (r *BatchResult) failed() int {
+	var n int
+	for _, res := range r.Results {
+		if res.Err != "" {
+			n++
+		}
+	}
+	return n
+}
+
+// applyBatchOp applies one op of Trans.Batch for user
+func (trans *Trans) applyBatchOp(user *ServerConfUser, op *BatchOp) error {
+	switch op.Op {
+	case batchOpCreate, batchOpUpdate:
+		fullName, relName, err := trans.cleanFileName(user, op.Name)
+		if err != nil {
+			return err
+		}
+		my := &MyFile{Name: op.Name, Data: op.Data, Gzip: true, Md5: op.Md5, Total: 1}
+		data, err := my.rawData()
+		if err != nil {
+			return err
+		}
+		my.Stat = &FileStat{Size: int64(len(data)), FileMode: op.Mode, Md5: op.Md5, Mtime: op.Mtime}
+		done, err := trans.uploads.writeChunk(fullName, my, data)
+		if done {
+			trans.blobs.add(user.Name, fullName, op.Md5)
+			trans.addEvent(user, relName, EventUpdate)
+		}
+		return err
+	case batchOpMkdir:
+		fullName, relName, err := trans.cleanFileName(user, op.Name)
+		if err != nil {
+			return err
+		}
+		if err = checkDir(fullName, op.Mode); err != nil {
+			return err
+		}
+		if err = applyFileMeta(fullName, &FileStat{FileMode: op.Mode}); err != nil {
+			return err
+		}
+		trans.addEvent(user, relName, EventUpdate)
+		return nil
+	case batchOpDelete:
+		if !user.can(permDelete) {
+			return fmt.Errorf("user %q has no %s permission", user.Name, permDelete)
+		}
+		return trans.removeFile(user, op.Name)
+	case batchOpRename:
+		return trans.renameFile(user, op.From, op.Name)
+	case batchOpSymlink:
+		fullName, relName, err := trans.cleanFileName(user, op.Name)
+		if err != nil {
+			return err
+		}
+		if err = trans.makeSymlink(user, fullName, op.Link); err != nil {
+			return err
+		}
+		trans.addEvent(user, relName, EventUpdate)
+		return nil
+	default:
+		return fmt.Errorf("unknown batch op %q", op.Op)
+	}
+}
+
+// clientBatch collects the ops of one Trans.Batch call in event order
+type clientBatch struct {
+	ops  []*BatchOp
+	size int
+}
+
+func (cb *clientBatch) add(op *BatchOp) {
+	cb.ops = append(cb.ops, op)
+	cb.size += len(op.Data)
+}
+
+func (cb *clientBatch) full() bool {
+	return cb.size >= batchMaxSize || len(cb.ops) >= batchMaxOps
+}
+
+// errBatchSkip the file is not sent in a batch
+var errBatchSkip = errors.New("skip batch")
+
+// newBatchUpdate reads absPath into a create/update, mkdir or symlink op,
+// errBatchSkip is returned when the file should be sent alone,
+// the op is nil when there is nothing to send
+func (hc *HSyncClient) newBatchUpdate(absPath string) (*BatchOp, error) {
+	absName, relName, err := hc.CheckPath(absPath)
+	if err != nil {
+		return nil, err
+	}
+	info, err := hc.index.stat(absName)
+	if err != nil {
+		return nil, err
+	}
+	op := &BatchOp{Name: filepath.ToSlash(relName), Mode: info.Mode()}
+	if info.Mode()&os.ModeSymlink != 0 {
+		if hc.conf.Symlink == symlinkSkip {
+			glog.V(2).Infoln("skip symlink", relName)
+			return nil, nil
+		}
+		op.Op = batchOpSymlink
+		op.Link, err = os.Readlink(absName)
+		op.Link = filepath.ToSlash(op.Link)
+		return op, err
+	}
+	if info.IsDir() {
+		op.Op = batchOpMkdir
+		go hc.addNewDir(absName)
+		return op, nil
+	}
+	if !info.Mode().IsRegular() || info.Size() > batchMaxFileSize {
+		return nil, errBatchSkip
+	}
+	data, err := os.ReadFile(absName)
+	if err != nil {
+		return nil, err
+	}
+	op.Op = batchOpUpdate
+	op.Mtime = info.ModTime()
+	op.Data = dataGzipEncode(data)
+	op.Md5 = ByteMd5(data)
+	return op, nil
+}
+
+// remoteBatch sends the ops in one Trans.Batch call,
+// the failed ops are sent again one by one
+func (hc *HSyncClient) remoteBatch(cb *clientBatch) {
+	if len(cb.ops) == 0 {
+		return
+	}
+	ops := cb.ops
+	cb.ops, cb.size = nil, 0
+
+	args := hc.NewArgs(".", nil)
+	args.Batch = ops
+	var result *BatchResult
+	err := hc.Call("Trans.Batch", args, &result)
+	if err == nil && len(result.Results) != len(ops) {
+		err = fmt.Errorf("got %d batch results, want %d", len(result.Results), len(ops))
+	}
+	if err != nil {
+		glog.Warningf("Batch [%d ops] failed, send one by one, err=%v", len(ops), err)
+		for _, op := range ops {
+			hc.retryBatchOp(op)
+		}
+		return
+	}
+	glog.Infof("Batch [%d ops] suc, %d failed", len(ops), result.failed())
+	for i, res := range result.Results {
+		if res.Err == "" {
+			glog.V(2).Infof("Batch %s [%s] suc", ops[i].Op, ops[i].Name)
+			continue
+		}
+		glog.Warningf("Batch %s [%s] failed,err=%s", ops[i].Op, ops[i].Name, res.Err)
+		hc.retryBatchOp(ops[i])
+	}
+}
+
+// retryBatchOp applies op with the single file rpc
+func (hc *HSyncClient) retryBatchOp(op *BatchOp) {
+	switch op.Op {
+	case batchOpDelete:
+		hc.RemoteDel(op.Name)
+	case batchOpRename:
+		hc.RemoteReName(op.Name, op.From)
+	default:
+		absPath, _, err := hc.CheckPath(op.Name)
+		if err == nil {
+			hc.RemoteSaveFile(absPath)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestTrans(home string) *Trans {
+	return &Trans{
+		server:  &HSyncServer{conf: &ServerConf{Home: home, StateDir: filepath.Join(home, ".hsyncd")}},
+		events:  make(map[string]*deployEvent),
+		flush:   make(chan struct{}, 1),
+		uploads: newUploadStore("", time.Minute),
+		blobs:   newBlobStore(filepath.Join(home, ".hsyncd", "blobs"), 1<<20),
+		stats:   &transStats{success: map[string]int64{}, fail: map[string]int64{}, denied: map[string]int64{}, last: map[string]string{}, blob: map[string]int64{}},
+	}
+}
+
+func TestTrans_applyBatchOp(t *testing.T) {
+	home := t.TempDir()
+	trans := newTestTrans(home)
+	user := &ServerConfUser{Name: "tom", Perms: []string{permWrite, permDeploy}}
+	data := []byte("hello")
+	ops := []*BatchOp{
+		{Op: batchOpMkdir, Name: "sub", Mode: os.ModeDir | 0755},
+		{Op: batchOpCreate, Name: "sub/a.txt", Mode: 0644, Data: dataGzipEncode(data), Md5: ByteMd5(data)},
+		{Op: batchOpRename, Name: "sub/b.txt", From: "sub/a.txt"},
+		{Op: batchOpUpdate, Name: "c.txt", Mode: 0644, Data: dataGzipEncode(data), Md5: StrMd5("other")},
+		{Op: batchOpDelete, Name: "sub/b.txt"},
+		{Op: batchOpUpdate, Name: "../d.txt", Mode: 0644, Data: dataGzipEncode(data), Md5: ByteMd5(data)},
+	}
+	var errs []error
+	for _, op := range ops {
+		errs = append(errs, trans.applyBatchOp(user, op))
+	}
+	require.NoError(t, errs[0])
+	require.NoError(t, errs[1])
+	require.NoError(t, errs[2])
+	require.True(t, isChecksumMismatch(errs[3]), errs[3])
+	require.ErrorContains(t, errs[4], "no delete permission")
+	var pe *PathDeniedError
+	require.ErrorAs(t, errs[5], &pe)
+
+	got, err := os.ReadFile(filepath.Join(home, "sub", "b.txt"))
+	require.NoError(t, err)
+	require.Equal(t, data, got)
+	_, err = os.Stat(filepath.Join(home, "c.txt"))
+	require.True(t, os.IsNotExist(err))
+	require.Equal(t, EventType(EventUpdate), trans.events["sub/b.txt"].Type)
+	require.Equal(t, EventType(EventDelete), trans.events["sub/a.txt"].Type)
+}
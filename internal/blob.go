@@ -0,0 +1,250 @@
+package internal
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// blobMinSize smaller files are cheaper to send than to look up by hash
+const blobMinSize = 64 << 10
+
+func isMd5Hex(s string) bool {
+	if len(s) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// blobStore keeps file contents keyed by md5, each user has its own blobs
+// so one user can not read the files of another by guessing a hash.
+// Blobs are hard links of the received files when possible, their mtime is
+// not touched since it is shared with the file, so gc removes the oldest first.
+// The blob cache is disabled when dir is empty.
+type blobStore struct {
+	dir     string
+	maxSize int64
+}
+
+func newBlobStore(dir string, maxSize int64) *blobStore {
+	bs := &blobStore{dir: dir, maxSize: maxSize}
+	if dir == "" {
+		return bs
+	}
+	if err := checkDir(dir, 0700); err != nil {
+		glog.Warningln("create blob dir failed, blob cache disabled:", err)
+		bs.dir = ""
+	}
+	return bs
+}
+
+func (bs *blobStore) path(userName string, md5 string) string {
+	return filepath.Join(bs.dir, userName, md5[:2], md5)
+}
+
+// add keeps name as the blob of md5, by hard link when possible
+func (bs *blobStore) add(userName string, name string, md5 string) {
+	if bs.dir == "" || !isMd5Hex(md5) {
+		return
+	}
+	info, err := os.Lstat(name)
+	if err != nil || !info.Mode().IsRegular() || info.Size() < blobMinSize {
+		return
+	}
+	blob := bs.path(userName, md5)
+	if _, err = os.Stat(blob); err == nil {
+		return
+	}
+	if err = checkDir(filepath.Dir(blob), 0700); err != nil {
+		glog.Warningln("create blob dir failed:", err)
+		return
+	}
+	if err = os.Link(name, blob); err != nil {
+		f, errOpen := os.Open(name)
+		if errOpen != nil {
+			return
+		}
+		defer f.Close()
+		err = replaceFile(blob, f, &FileStat{FileMode: 0600, Md5: md5})
+	}
+	if err != nil {
+		glog.Warningln("add blob", md5, "failed:", err)
+		return
+	}
+	glog.V(2).Infoln("add blob", md5, "from", name)
+}
+
+// open returns the blob of md5, it is not verified
+func (bs *blobStore) open(userName string, md5 string) (*os.File, error) {
+	if bs.dir == "" || !isMd5Hex(md5) {
+		return nil, os.ErrNotExist
+	}
+	return os.Open(bs.path(userName, md5))
+}
+
+func (bs *blobStore) remove(userName string, md5 string) {
+	if bs.dir == "" || !isMd5Hex(md5) {
+		return
+	}
+	os.Remove(bs.path(userName, md5))
+}
+
+func (bs *blobStore) gcLoop() {
+	if bs.dir == "" {
+		return
+	}
+	tk := time.NewTicker(10 * time.Minute)
+	defer tk.Stop()
+	for range tk.C {
+		bs.gc()
+	}
+}
+
+// gc removes the oldest blobs until the total size is under maxSize
+func (bs *blobStore) gc() {
+	type blobInfo struct {
+		path  string
+		size  int64
+		mtime time.Time
+	}
+	var blobs []blobInfo
+	var total int64
+	filepath.WalkDir(bs.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if isUploadTmp(path) && time.Since(info.ModTime()) > time.Hour {
+			os.Remove(path)
+			return nil
+		}
+		blobs = append(blobs, blobInfo{path: path, size: info.Size(), mtime: info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+	if total <= bs.maxSize {
+		return
+	}
+	sort.Slice(blobs, func(i, j int) bool {
+		return blobs[i].mtime.Before(blobs[j].mtime)
+	})
+	var removed int
+	for _, b := range blobs {
+		if total <= bs.maxSize {
+			break
+		}
+		if err := os.Remove(b.path); err == nil {
+			total -= b.size
+			removed++
+		}
+	}
+	glog.Infoln("blob gc removed", removed, "blobs, total size", total)
+}
+
+// stashBlobs keeps the files under fullName in the blob cache before
+// they are deleted, so a moved file is not sent again
+func (trans *Trans) stashBlobs(user *ServerConfUser, fullName string) {
+	if trans.blobs.dir == "" {
+		return
+	}
+	filepath.WalkDir(fullName, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || info.Size() < blobMinSize {
+			return nil
+		}
+		trans.blobs.add(user.Name, path, trans.index.fileMd5(path, info))
+		return nil
+	})
+}
+
+// copyByHash creates fullName from the blob cache or an existing file of user
+// with the content of stat, from is empty when there is no such content
+func (trans *Trans) copyByHash(user *ServerConfUser, fullName string, stat *FileStat) (from string, err error) {
+	want := &FileStat{FileMode: stat.FileMode, Md5: stat.Md5, Mtime: stat.Mtime}
+	if f, err := trans.blobs.open(user.Name, stat.Md5); err == nil {
+		err = replaceFile(fullName, f, want)
+		f.Close()
+		if err == nil {
+			return "cache", nil
+		}
+		glog.Warningln("copy from blob", stat.Md5, "failed:", err)
+		if isChecksumMismatch(err) {
+			trans.blobs.remove(user.Name, stat.Md5)
+		}
+	}
+	root := filepath.Join(trans.server.conf.Home, user.Root)
+	for _, name := range trans.index.lookup(stat.Md5) {
+		if !isSubPath(root, name) {
+			continue
+		}
+		f, err := os.Open(name)
+		if err != nil {
+			continue
+		}
+		err = replaceFile(fullName, f, want)
+		f.Close()
+		if err == nil {
+			trans.blobs.add(user.Name, fullName, stat.Md5)
+			return name, nil
+		}
+		if !isChecksumMismatch(err) {
+			return "", err
+		}
+	}
+	return "", nil
+}
+
+// replaceFile writes r into a temp file in the same dir, verifies it with
+// stat.Md5 when not empty, then renames it over target.
+// The mtime is set when stat.Mtime is not zero.
+func replaceFile(target string, r io.Reader, stat *FileStat) error {
+	dir := filepath.Dir(target)
+	if err := checkDir(dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, uploadTmpPrefix+filepath.Base(target)+"-*")
+	if err != nil {
+		return err
+	}
+	tmpName := f.Name()
+	h := md5.New()
+	_, err = io.Copy(io.MultiWriter(f, h), r)
+	if got := hex.EncodeToString(h.Sum(nil)); err == nil && stat.Md5 != "" && got != stat.Md5 {
+		err = &ChecksumError{Name: target, Want: stat.Md5, Got: got}
+	}
+	if err == nil {
+		err = f.Chmod(stat.FileMode.Perm())
+	}
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	if err == nil && !stat.Mtime.IsZero() {
+		err = os.Chtimes(tmpName, stat.Mtime, stat.Mtime)
+	}
+	if err == nil {
+		if info, errStat := os.Lstat(target); errStat == nil && info.IsDir() {
+			err = os.RemoveAll(target)
+		}
+	}
+	if err == nil {
+		err = os.Rename(tmpName, target)
+	}
+	if err != nil {
+		os.Remove(tmpName)
+	}
+	return err
+}
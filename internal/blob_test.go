@@ -0,0 +1,68 @@
+package internal
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrans_copyByHash(t *testing.T) {
+	home := t.TempDir()
+	trans := newTestTrans(home)
+	trans.index = openHashIndex(filepath.Join(home, ".hsyncd", hashIndexFileName))
+	tom := &ServerConfUser{Name: "tom", Root: "tom"}
+	jack := &ServerConfUser{Name: "jack", Root: "jack"}
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), blobMinSize/16)
+	stat := &FileStat{FileMode: 0640, Md5: ByteMd5(data)}
+	src := filepath.Join(home, "tom", "a.bin")
+	require.NoError(t, os.MkdirAll(filepath.Dir(src), 0755))
+	require.NoError(t, os.WriteFile(src, data, 0644))
+	old := time.Now().Add(-time.Minute)
+	require.NoError(t, os.Chtimes(src, old, old))
+
+	// no blob and the file is not in the index yet
+	from, err := trans.copyByHash(tom, filepath.Join(home, "tom", "b.bin"), stat)
+	require.NoError(t, err)
+	require.Empty(t, from)
+
+	var st FileStat
+	require.NoError(t, trans.index.fileGetStat(src, &st, true))
+	from, err = trans.copyByHash(tom, filepath.Join(home, "tom", "b.bin"), stat)
+	require.NoError(t, err)
+	require.Equal(t, src, from)
+	got, err := os.ReadFile(filepath.Join(home, "tom", "b.bin"))
+	require.NoError(t, err)
+	require.Equal(t, data, got)
+
+	// the file of another user is not used
+	from, err = trans.copyByHash(jack, filepath.Join(home, "jack", "b.bin"), stat)
+	require.NoError(t, err)
+	require.Empty(t, from)
+
+	// a deleted file is kept in the blob cache
+	trans.stashBlobs(tom, filepath.Join(home, "tom"))
+	require.NoError(t, os.RemoveAll(filepath.Join(home, "tom")))
+	from, err = trans.copyByHash(tom, filepath.Join(home, "tom", "c.bin"), stat)
+	require.NoError(t, err)
+	require.Equal(t, "cache", from)
+	info, err := os.Stat(filepath.Join(home, "tom", "c.bin"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0640), info.Mode().Perm())
+
+	// a broken blob is removed
+	blob := trans.blobs.path(tom.Name, stat.Md5)
+	require.NoError(t, os.Remove(blob))
+	require.NoError(t, os.WriteFile(blob, []byte("broken"), 0600))
+	from, err = trans.copyByHash(tom, filepath.Join(home, "tom", "d.bin"), stat)
+	require.NoError(t, err)
+	require.Empty(t, from)
+	_, err = os.Stat(blob)
+	require.True(t, os.IsNotExist(err))
+	matches, _ := filepath.Glob(filepath.Join(home, "tom", uploadTmpPrefix+"*"))
+	require.Empty(t, matches)
+}
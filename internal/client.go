@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"crypto/tls"
 	"errors"
 	"flag"
 	"fmt"
@@ -27,6 +28,8 @@ type HSyncClient struct {
 	reNameEvent     *fsnotify.Event
 	fileCount       uint64
 	remoteHost      *ServerHost
+	auth            clientAuth
+	index           *hashIndex
 }
 
 type EventType int
@@ -59,7 +62,9 @@ func NewHSyncClient(confName string, hostName string) (*HSyncClient, error) {
 	hc := &HSyncClient{
 		conf:   conf,
 		events: make([]*ClientEvent, 0),
+		index:  openHashIndex(filepath.Join(conf.StateDir, hashIndexFileName)),
 	}
+	hc.index.followLinks = conf.Symlink == symlinkFollow
 	if err = hc.chooseHost(hostName); err != nil {
 		return nil, err
 	}
@@ -97,7 +102,6 @@ func (hc *HSyncClient) NewArgs(fileName string, myFile *MyFile) *RpcArgs {
 		myFile.Name = filepath.ToSlash(myFile.Name)
 	}
 	return &RpcArgs{
-		Token:    hc.remoteHost.Token,
 		FileName: filepath.ToSlash(fileName),
 		MyFile:   myFile,
 	}
@@ -107,13 +111,21 @@ func (hc *HSyncClient) Start() error {
 	if err := hc.Connect(); err != nil {
 		return err
 	}
+	go hc.index.saveLoop()
 	return hc.Watch()
 }
 
-func (hc *HSyncClient) Connect() error {
+func (hc *HSyncClient) Connect() (err error) {
 	num := hc.connectTryTimes.Add(1)
 	glog.Infoln("connect to", hc.remoteHost.Host, "tryTimes:", num)
-	client, err := RpcDialHTTPPath("tcp", hc.remoteHost.Host, rpc.DefaultRPCPath, 2*time.Second)
+	var tlsConf *tls.Config
+	if hc.remoteHost.TLS != nil {
+		tlsConf, err = hc.remoteHost.TLS.tlsConfig(hc.remoteHost.Host)
+		if err != nil {
+			return err
+		}
+	}
+	client, err := RpcDialHTTPPath("tcp", hc.remoteHost.Host, rpc.DefaultRPCPath, 2*time.Second, tlsConf)
 	if err != nil {
 		glog.Warningln("connect err", err)
 		return err
@@ -154,6 +166,15 @@ checkConnect:
 			time.Sleep(1 * time.Second)
 		}
 	}
+	if arg, ok := args.(*RpcArgs); ok {
+		if err = hc.signArgs(method, arg); err != nil {
+			if err == rpc.ErrShutdown {
+				hc.client = nil
+				goto checkConnect
+			}
+			return err
+		}
+	}
 	isTimeout := false
 
 	timeout := time.AfterFunc(30*time.Second, func() {
@@ -171,6 +192,12 @@ checkConnect:
 		hc.client = nil
 		goto checkConnect
 	}
+	if isSessionExpired(err) {
+		timeout.Stop()
+		glog.Warningln("Call", method, "session expired, login again")
+		hc.auth.reset()
+		goto checkConnect
+	}
 	if err != nil {
 		glog.Warningln("\n==============================================================")
 		glog.Warningln("Call", method, "failed,", err)
@@ -181,6 +208,17 @@ checkConnect:
 	return err
 }
 
+// signArgs fills the session credential of the call of method with arg,
+// login when there is no valid session
+func (hc *HSyncClient) signArgs(method string, arg *RpcArgs) error {
+	if err := hc.auth.ensure(hc.remoteHost.Token, hc.client.Call); err != nil {
+		glog.Warningln("auth login failed:", err)
+		return err
+	}
+	hc.auth.sign(method, arg)
+	return nil
+}
+
 func (hc *HSyncClient) RemoteVersion() string {
 	var serverVersion string
 	hc.Call("Trans.Version", version, &serverVersion)
@@ -189,7 +227,7 @@ func (hc *HSyncClient) RemoteVersion() string {
 }
 
 func (hc *HSyncClient) RemoteSaveFile(absPath string) error {
-	return hc.remoteSaveFile(absPath, nil)
+	return hc.remoteSaveFile(absPath)
 }
 
 func (hc *HSyncClient) RemoteFileTruncate(absPath string) error {
@@ -207,14 +245,54 @@ func (hc *HSyncClient) RemoteFileTruncate(absPath string) error {
 	return err
 }
 
-func (hc *HSyncClient) remoteSaveFile(absPath string, ignoreParts map[int64]int) error {
+// sendRetryTimes how many times a file is sent when the server reports a checksum mismatch
+const sendRetryTimes = 3
+
+func (hc *HSyncClient) remoteSaveFile(absPath string) (err error) {
+	if hc.remoteCopyByHash(absPath) {
+		return nil
+	}
+	for i := 1; i <= sendRetryTimes; i++ {
+		err = hc.sendFile(absPath)
+		if !isChecksumMismatch(err) {
+			return err
+		}
+		glog.Warningf("Send File [%s] checksum mismatch, try %d/%d, err=%v", absPath, i, sendRetryTimes, err)
+	}
+	return err
+}
+
+// remoteCopyByHash asks the server to create the file from the content it
+// already has, it reports whether the data need not be sent
+func (hc *HSyncClient) remoteCopyByHash(absPath string) bool {
+	absName, relName, err := hc.CheckPath(absPath)
+	if err != nil {
+		return false
+	}
+	info, err := hc.index.stat(absName)
+	if err != nil || !info.Mode().IsRegular() || info.Size() < blobMinSize {
+		return false
+	}
+	var stat FileStat
+	if err = hc.index.fileGetStat(absName, &stat, true); err != nil {
+		return false
+	}
+	var reply int
+	err = hc.Call("Trans.CopyByHash", hc.NewArgs(relName, &MyFile{Name: relName, Stat: &stat}), &reply)
+	if reply != 1 {
+		glog.V(2).Infof("Copy By Hash [%s] miss, err=%v", relName, err)
+		return false
+	}
+	glog.Infof("Copy By Hash [%s] suc, size=%d", relName, stat.Size)
+	return true
+}
+
+func (hc *HSyncClient) sendFile(absPath string) error {
 	absName, relName, err := hc.CheckPath(absPath)
 	if err != nil {
 		return err
 	}
-	var index int64 = 0
-sendSlice:
-	f, err := fileGetMyFile(absName, index)
+	f, err := hc.index.fileGetMyFile(absName, 0)
 	if err != nil {
 		glog.Warningf("Send FIle [%s] failed,get file failed,err=%v", relName, err)
 		return err
@@ -223,50 +301,93 @@ sendSlice:
 	if f.Stat.IsDir() {
 		go hc.addNewDir(absName)
 	}
-
-	isNotDone := f.Total > 1 && index+1 < f.Total
-
-	logMsg := fmt.Sprintf("Send File [%s] [%3d / %d]", relName, index+1, f.Total)
-
-	if isNotDone && ignoreParts != nil {
-		if _, has := ignoreParts[index]; has {
-			glog.Infoln(logMsg, "Skip")
-			index++
-			goto sendSlice
-		}
+	if f.Stat.IsLink() && hc.conf.Symlink == symlinkSkip {
+		glog.V(2).Infoln("skip symlink", relName)
+		return nil
+	}
+	if f.Total > 1 {
+		return hc.remoteUpload(absName, relName, f)
 	}
 
+	logMsg := fmt.Sprintf("Send File [%s] [%3d / %d]", relName, 1, f.Total)
 	f.Name = relName
 	var reply int
 	err = hc.Call("Trans.CopyFile", hc.NewArgs(relName, f), &reply)
 	if reply == 1 {
 		glog.Infoln(logMsg, "Suc")
-		if isNotDone {
-			index++
-			goto sendSlice
-		}
 	} else {
 		glog.Warningln(logMsg, "failed,err=", err)
 	}
-
 	return err
 }
 
-func (hc *HSyncClient) RemoteGetStat(name string) (stat *FileStat, err error) {
-	_, relName, err := hc.CheckPath(name)
-	if err != nil {
-		return nil, err
+// remoteUpload sends a file larger than one chunk within an upload session,
+// chunks the server already has are skipped
+func (hc *HSyncClient) remoteUpload(absName string, relName string, first *MyFile) error {
+	begin := &MyFile{
+		Name:  relName,
+		Stat:  first.Stat,
+		Total: first.Total,
+	}
+	var session *UploadSession
+	if err := hc.Call("Trans.BeginUpload", hc.NewArgs(relName, begin), &session); err != nil {
+		glog.Warningf("Send File [%s] begin upload failed,err=%v", relName, err)
+		return err
 	}
-	err = hc.Call("Trans.FileStat", hc.NewArgs(relName, nil), &stat)
-	return
+	have := make(map[int64]bool, len(session.Have))
+	for _, index := range session.Have {
+		have[index] = true
+	}
+
+	for index := int64(0); index < first.Total; index++ {
+		logMsg := fmt.Sprintf("Send File [%s] [%3d / %d]", relName, index+1, first.Total)
+		if have[index] {
+			glog.Infoln(logMsg, "Skip")
+			continue
+		}
+		f := first
+		if index > 0 {
+			var err error
+			if f, err = hc.index.fileGetMyFile(absName, index); err != nil {
+				glog.Warningf("Send FIle [%s] failed,get file failed,err=%v", relName, err)
+				return err
+			}
+		}
+		f.Name = relName
+		f.UploadID = session.ID
+		var reply int
+		err := hc.Call("Trans.CopyFile", hc.NewArgs(relName, f), &reply)
+		if reply != 1 {
+			glog.Warningln(logMsg, "failed,err=", err)
+			return err
+		}
+		glog.Infoln(logMsg, "Suc")
+	}
+
+	begin.UploadID = session.ID
+	var reply int
+	err := hc.Call("Trans.CommitUpload", hc.NewArgs(relName, begin), &reply)
+	if reply != 1 {
+		glog.Warningf("Send File [%s] commit failed,err=%v", relName, err)
+		return err
+	}
+	glog.Infof("Send File [%s] commit suc", relName)
+	return nil
+}
+
+func (hc *HSyncClient) RemoteGetStat(name string) (stat *FileStat, err error) {
+	return hc.remoteGetStat(name, compareChecksum)
 }
 
-func (hc *HSyncClient) RemoteGetStatSlice(name string) (stat *FileStatSlice, err error) {
+// remoteGetStat gets the stat of the server file with the hash compare needs
+func (hc *HSyncClient) remoteGetStat(name string, compare string) (stat *FileStat, err error) {
 	_, relName, err := hc.CheckPath(name)
 	if err != nil {
 		return nil, err
 	}
-	err = hc.Call("Trans.FileStatSlice", hc.NewArgs(relName, nil), &stat)
+	args := hc.NewArgs(relName, nil)
+	args.Compare = compare
+	err = hc.Call("Trans.FileStat", args, &stat)
 	return
 }
 
@@ -337,8 +458,9 @@ func (hc *HSyncClient) CheckOrSend(absName string) (err error) {
 		return
 	}
 remoteCheck:
+	compare := hc.conf.Compare
 	var localStat FileStat
-	err = fileGetStat(absPath, &localStat, true)
+	err = hc.index.fileGetStatCompare(absPath, &localStat, compare)
 	if err != nil {
 		return
 	}
@@ -347,8 +469,12 @@ remoteCheck:
 		glog.Infoln("[", id, "]", relPath, "is pipe file, ignored")
 		return
 	}
+	if localStat.IsLink() && hc.conf.Symlink == symlinkSkip {
+		glog.V(2).Infoln("[", id, "]", relPath, "is symlink, skipped")
+		return
+	}
 
-	remoteStat, err := hc.RemoteGetStat(absPath)
+	remoteStat, err := hc.remoteGetStat(absPath, compare)
 	if err != nil {
 		glog.Warningln("[", id, "] sync get stat failed", err)
 		return
@@ -359,44 +485,141 @@ remoteCheck:
 		glog.Infoln("[", id, "]", relPath, "local_is_dir_but_remote_is_not_dir,delete:", err)
 		goto remoteCheck
 	}
-	if !remoteStat.Exists || localStat.Md5 != remoteStat.Md5 {
-		if localStat.Size/TransMaxLength < 3 {
-			err = hc.RemoteSaveFile(absPath)
+	changed := !remoteStat.Exists || localStat.IsLink() != remoteStat.IsLink() || localStat.Link != remoteStat.Link
+	if !changed && compare != compareChecksum {
+		switch {
+		case quickSame(&localStat, remoteStat):
+			glog.V(2).Infoln("[", id, "]", relPath, "passed quick-check")
+		case localStat.Size != remoteStat.Size || localStat.Sample != remoteStat.Sample:
+			changed = true
+		default:
+			// only the mtime differs, the content may be the same
+			if err = hc.index.fileGetStat(absPath, &localStat, true); err != nil {
+				return
+			}
+			if remoteStat, err = hc.RemoteGetStat(absPath); err != nil {
+				glog.Warningln("[", id, "] sync get stat failed", err)
+				return
+			}
+			changed = localStat.Md5 != remoteStat.Md5
+		}
+	} else if !changed {
+		changed = localStat.Md5 != remoteStat.Md5
+	}
+	if changed {
+		// delta is only based on a regular file on both sides
+		if remoteStat.Exists && remoteStat.FileMode.IsRegular() && localStat.FileMode.IsRegular() && localStat.Size >= hc.conf.DeltaThreshold {
+			err = hc.deltaSend(absPath)
 		} else {
-			err = hc.flashSend(absPath)
+			err = hc.RemoteSaveFile(absPath)
 		}
+	} else if localStat.metaDiffer(remoteStat) {
+		err = hc.RemoteFileMeta(absPath, &localStat)
 	} else {
 		glog.Infoln("[", id, "]", relPath, "Not Change")
 	}
 	return
 }
 
-func (hc *HSyncClient) flashSend(absName string) (err error) {
-	absPath, relPath, err := hc.CheckPath(absName)
+// RemoteFlush tells the server the changes sent are complete, so it deploys them now
+func (hc *HSyncClient) RemoteFlush() {
+	var reply int
+	if err := hc.Call("Trans.Flush", hc.NewArgs(".", nil), &reply); err != nil {
+		// servers before Trans.Flush deploy after the settle window
+		glog.V(2).Infoln("Flush failed:", err)
+	}
+}
+
+// RemoteFileMeta sends only the mode and mtime of the file
+func (hc *HSyncClient) RemoteFileMeta(absPath string, stat *FileStat) error {
+	_, relName, err := hc.CheckPath(absPath)
 	if err != nil {
 		return err
 	}
-	var localStatSlice FileStatSlice
-	err = fileGetStatSlice(absPath, &localStatSlice)
+	var reply int
+	err = hc.Call("Trans.FileMeta", hc.NewArgs(relName, &MyFile{Name: relName, Stat: stat}), &reply)
+	if reply == 1 {
+		glog.Infof("File Meta [%s] mode=%v suc", relName, stat.FileMode.Perm())
+	} else {
+		glog.Warningf("File Meta [%s] failed,err=%v", relName, err)
+	}
+	return err
+}
+
+// deltaSend sends only the difference between the local file and the server copy
+func (hc *HSyncClient) deltaSend(absName string) (err error) {
+	absPath, relPath, err := hc.CheckPath(absName)
 	if err != nil {
 		return err
 	}
-	remoteStatSlice, err := hc.RemoteGetStatSlice(relPath)
+	var sig *FileSignature
+	if err = hc.Call("Trans.FileSignature", hc.NewArgs(relPath, nil), &sig); err != nil {
+		glog.Warningf("Delta Send [%s] get signature failed, send whole file, err=%v", relPath, err)
+		return hc.RemoteSaveFile(absPath)
+	}
+	if !sig.Exists {
+		return hc.RemoteSaveFile(absPath)
+	}
+
+	stat := new(FileStat)
+	if err = hc.index.fileGetStat(absPath, stat, true); err != nil {
+		return err
+	}
+	f, err := os.Open(absPath)
 	if err != nil {
 		return err
 	}
-	ignoreParts := make(map[int64]int)
-	for index, statPart := range localStatSlice.Parts {
-		if int64(index)+1 > remoteStatSlice.Total || statPart.Md5 != remoteStatSlice.Parts[index].Md5 {
-		} else {
-			ignoreParts[int64(index)] = 1
+	defer f.Close()
+
+	my := &MyFile{Name: relPath, Stat: stat}
+	var ops []*DeltaOp
+	var opsSize, literal, sent int64
+	send := func() error {
+		args := hc.NewArgs(relPath, my)
+		args.Delta = ops
+		var session *UploadSession
+		if err := hc.Call("Trans.ApplyDelta", args, &session); err != nil {
+			return err
+		}
+		my.UploadID = session.ID
+		for _, op := range ops {
+			my.Pos += op.Len
 		}
+		ops, opsSize = nil, 0
+		return nil
 	}
-	err = hc.remoteSaveFile(absPath, ignoreParts)
-	// 	if err == nil && localStatSlice.Size < remoteStatSlice.Size {
-	// 		err = hc.RemoteFileTruncate(absPath)
-	// 	}
-	return err
+	err = computeDelta(f, sig, func(op *DeltaOp) error {
+		ops = append(ops, op)
+		opsSize += int64(len(op.Data)) + 16
+		if op.isLiteral() {
+			literal += op.Len
+		}
+		sent += int64(len(op.Data))
+		if opsSize >= TransMaxLength || len(ops) >= 10000 {
+			return send()
+		}
+		return nil
+	})
+	if err == nil && (len(ops) > 0 || my.UploadID == "") {
+		err = send()
+	}
+	if err != nil {
+		glog.Warningf("Delta Send [%s] failed,err=%v", relPath, err)
+		return err
+	}
+
+	var reply int
+	err = hc.Call("Trans.CommitUpload", hc.NewArgs(relPath, my), &reply)
+	if isChecksumMismatch(err) {
+		glog.Warningf("Delta Send [%s] checksum mismatch, send whole file", relPath)
+		return hc.RemoteSaveFile(absPath)
+	}
+	if err != nil {
+		glog.Warningf("Delta Send [%s] commit failed,err=%v", relPath, err)
+		return err
+	}
+	glog.Infof("Delta Send [%s] suc, size=%d, literal=%d, sent=%d", relPath, stat.Size, literal, sent)
+	return nil
 }
 
 func (hc *HSyncClient) Watch() (err error) {
@@ -432,7 +655,7 @@ func (hc *HSyncClient) Watch() (err error) {
 
 func (hc *HSyncClient) addWatch(dir string) {
 	start := time.Now()
-	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+	err := syncWalk(dir, hc.conf.Symlink, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			glog.Warningf("walk %q with error  %v and skipped", dir, err)
 			return nil
@@ -494,6 +717,8 @@ func (hc *HSyncClient) eventLoop() {
 
 		eventCache := make(map[string]time.Time)
 
+		// update, delete and rename events are sent in batches, in the order of events
+		var batch clientBatch
 		var wg sync.WaitGroup
 		for _, ev := range events {
 			cacheKey := ev.AsKey()
@@ -505,7 +730,15 @@ func (hc *HSyncClient) eventLoop() {
 
 			switch ev.EventType {
 			case EventUpdate:
-				hc.RemoteSaveFile(ev.Name)
+				op, err := hc.newBatchUpdate(ev.Name)
+				if err == errBatchSkip {
+					hc.remoteBatch(&batch)
+					hc.RemoteSaveFile(ev.Name)
+				} else if err != nil {
+					glog.Warningln("read", ev.Name, "failed,skipped:", err)
+				} else if op != nil {
+					batch.add(op)
+				}
 			case EventCheck:
 
 				// hc.CheckOrSend(ev.Name)
@@ -518,14 +751,22 @@ func (hc *HSyncClient) eventLoop() {
 					wg.Done()
 				})(ev.Name)
 			case EventDelete:
-				hc.RemoteDel(ev.Name)
+				_, relName, _ := hc.CheckPath(ev.Name)
+				batch.add(&BatchOp{Op: batchOpDelete, Name: filepath.ToSlash(relName)})
 			case EventRename:
-				hc.RemoteReName(ev.Name, ev.NameTo)
+				_, relName, _ := hc.CheckPath(ev.Name)
+				_, relNameOld, _ := hc.CheckPath(ev.NameTo)
+				batch.add(&BatchOp{Op: batchOpRename, Name: filepath.ToSlash(relName), From: filepath.ToSlash(relNameOld)})
 			default:
 				glog.Warningln("unknown event:", ev)
 			}
+			if batch.full() {
+				hc.remoteBatch(&batch)
+			}
 		}
+		hc.remoteBatch(&batch)
 		wg.Wait()
+		hc.RemoteFlush()
 	}
 
 	ticker := time.NewTicker(1 * time.Second)
@@ -537,13 +778,30 @@ func (hc *HSyncClient) eventLoop() {
 }
 
 func (hc *HSyncClient) sync() {
-	hc.addNewDir(hc.conf.Home)
+	if hc.shouldTarPush() {
+		err := hc.tarPush()
+		if err == nil {
+			return
+		}
+		glog.Warningln("tar push failed, sync by manifest:", err)
+	}
+	if err := hc.syncManifest(); err != nil {
+		glog.Warningln("sync by manifest failed, check all files:", err)
+		hc.addNewDir(hc.conf.Home)
+	}
+	if err := hc.index.save(); err != nil {
+		glog.Warningln("save hash index failed:", err)
+	}
 }
 
 func (hc *HSyncClient) addNewDir(dirPath string) {
 	hc.addWatch(dirPath)
 	glog.Infoln("sync", dirPath, "start")
-	err := filepath.Walk(dirPath, func(path string, info os.FileInfo, err error) error {
+	err := syncWalk(dirPath, hc.conf.Symlink, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			glog.Warningf("walk %q with error %v and skipped", path, err)
+			return nil
+		}
 		absPath, relPath, _ := hc.CheckPath(path)
 		glog.V(2).Info("sync walk ", relPath)
 		if hc.conf.IsIgnore(relPath) {
@@ -584,7 +842,7 @@ func (hc *HSyncClient) eventHandler(event fsnotify.Event) {
 		} else {
 			hc.addEvent(absPath, EventUpdate, "")
 		}
-		stat, err := os.Stat(absPath)
+		stat, err := hc.index.stat(absPath)
 		if err == nil && stat.IsDir() {
 			hc.addWatch(absPath)
 		}
@@ -593,7 +851,7 @@ func (hc *HSyncClient) eventHandler(event fsnotify.Event) {
 	}
 
 	if event.Op&fsnotify.Write == fsnotify.Write {
-		stat, err := os.Stat(absPath)
+		stat, err := hc.index.stat(absPath)
 		if err != nil {
 			glog.Warningln("get file stat failed,err=", err, "event=", event)
 			return
@@ -617,8 +875,9 @@ func (hc *HSyncClient) eventHandler(event fsnotify.Event) {
 		hc.watcher.Remove(absPath)
 	}
 
+	// chmod and touch, only the changed metadata is sent after checking
 	if event.Op&fsnotify.Chmod == fsnotify.Chmod {
-		hc.addEvent(absPath, EventUpdate, "")
+		hc.addEvent(absPath, EventCheck, "")
 	}
 }
 
@@ -19,6 +19,18 @@ type ClientConf struct {
 	ConfDir  string
 	ignoreCr *ConfRegexp
 	allowCr  *ConfRegexp
+
+	// DeltaThreshold files not smaller than it are sent by rsync-style delta, default is 30MB
+	DeltaThreshold int64 `json:"deltaThreshold"`
+
+	// StateDir saves the client state such as the hash index, default is ".hsync" in ConfDir
+	StateDir string `json:"stateDir"`
+
+	// Symlink the policy of symlinks: preserve, follow or skip, default is preserve
+	Symlink string `json:"symlink"`
+
+	// Compare how files are compared with the server: checksum, quick or quick+sample, default is checksum
+	Compare string `json:"compare"`
 }
 
 var _ fsconf.AutoChecker = (*ClientConf)(nil)
@@ -27,6 +39,23 @@ func (cfg *ClientConf) AutoCheck() error {
 	if len(cfg.Hosts) == 0 {
 		return errors.New("miss server hosts")
 	}
+	if cfg.DeltaThreshold <= 0 {
+		cfg.DeltaThreshold = 3 * TransMaxLength
+	}
+	switch cfg.Symlink {
+	case "":
+		cfg.Symlink = symlinkPreserve
+	case symlinkPreserve, symlinkFollow, symlinkSkip:
+	default:
+		return fmt.Errorf("invalid symlink policy %q", cfg.Symlink)
+	}
+	switch cfg.Compare {
+	case "":
+		cfg.Compare = compareChecksum
+	case compareChecksum, compareQuick, compareQuickSample:
+	default:
+		return fmt.Errorf("invalid compare strategy %q", cfg.Compare)
+	}
 	for name, h := range cfg.Hosts {
 		h.Host = strings.TrimSpace(h.Host)
 		if h.Host == "" {
@@ -37,8 +66,9 @@ func (cfg *ClientConf) AutoCheck() error {
 }
 
 type ServerHost struct {
-	Host  string `json:"host"`
-	Token string `json:"token"`
+	Host  string         `json:"host"`
+	Token string         `json:"token"`
+	TLS   *ClientConfTLS `json:"tls"`
 }
 
 func (cfg *ClientConf) String() string {
@@ -86,7 +116,8 @@ func LoadClientConf(name string) (cfg *ClientConf, err error) {
 		return nil, err
 	}
 
-	err = fsconf.Parse(fp, &cfg)
+	cfg = &ClientConf{}
+	err = fsconf.Parse(fp, cfg)
 	if err != nil {
 		logErr(err)
 		return nil, err
@@ -97,6 +128,15 @@ func LoadClientConf(name string) (cfg *ClientConf, err error) {
 		cfg.Home = filepath.Join(cfg.ConfDir, cfg.Home)
 	}
 	cfg.Home = filepath.Clean(cfg.Home)
+	if cfg.StateDir == "" {
+		cfg.StateDir = ".hsync"
+	}
+	cfg.StateDir = confPath(cfg.ConfDir, cfg.StateDir)
+	for _, h := range cfg.Hosts {
+		if h.TLS != nil {
+			h.TLS.parse(cfg.ConfDir)
+		}
+	}
 
 	glog.V(2).Info("load cfg [", name, "] success,", cfg)
 	return
@@ -0,0 +1,72 @@
+package internal
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"os"
+)
+
+// the comparison strategies of ClientConf.Compare
+const (
+	// compareChecksum compares the md5 of the whole file
+	compareChecksum = "checksum"
+
+	// compareQuick compares size and mtime, trusting the preserved mtime
+	compareQuick = "quick"
+
+	// compareQuickSample compares size, mtime and the hash of the first and last blocks
+	compareQuickSample = "quick+sample"
+)
+
+// compareSampleSize the size of the first and the last block hashed by quick+sample
+const compareSampleSize = 64 << 10
+
+// fileSample the md5 of the first and last compareSampleSize bytes of name
+func fileSample(name string, size int64) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := md5.New()
+	if size <= 2*compareSampleSize {
+		_, err = io.Copy(h, f)
+	} else {
+		_, err = io.Copy(h, io.NewSectionReader(f, 0, compareSampleSize))
+		if err == nil {
+			_, err = io.Copy(h, io.NewSectionReader(f, size-compareSampleSize, compareSampleSize))
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// fileGetStatCompare gets the stat of name with the hash compare needs:
+// the md5 for checksum, nothing for quick and the sample for quick+sample
+func (hi *hashIndex) fileGetStatCompare(name string, stat *FileStat, compare string) error {
+	quick := compare == compareQuick || compare == compareQuickSample
+	if err := hi.fileGetStat(name, stat, !quick); err != nil {
+		return err
+	}
+	if compare == compareQuickSample && stat.Exists && stat.FileMode.IsRegular() {
+		var err error
+		stat.Sample, err = fileSample(name, stat.Size)
+		return err
+	}
+	return nil
+}
+
+// quickSame reports whether local and remote pass the quick-check,
+// the mode is not compared since it is sent without the content
+func quickSame(local *FileStat, remote *FileStat) bool {
+	if !remote.Exists || local.IsDir() != remote.IsDir() || local.IsLink() != remote.IsLink() || local.Link != remote.Link {
+		return false
+	}
+	if local.IsDir() || local.IsLink() {
+		return true
+	}
+	return local.Size == remote.Size && local.Mtime.Unix() == remote.Mtime.Unix() && local.Sample == remote.Sample
+}
@@ -0,0 +1,83 @@
+package internal
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileSample(t *testing.T) {
+	dir := t.TempDir()
+	data := bytes.Repeat([]byte("a"), 3*compareSampleSize)
+	name := filepath.Join(dir, "a.bin")
+	require.NoError(t, os.WriteFile(name, data, 0644))
+	s1, err := fileSample(name, int64(len(data)))
+	require.NoError(t, err)
+
+	// the middle is not sampled
+	data[compareSampleSize+1] = 'b'
+	require.NoError(t, os.WriteFile(name, data, 0644))
+	s2, err := fileSample(name, int64(len(data)))
+	require.NoError(t, err)
+	require.Equal(t, s1, s2)
+
+	data[len(data)-1] = 'b'
+	require.NoError(t, os.WriteFile(name, data, 0644))
+	s3, err := fileSample(name, int64(len(data)))
+	require.NoError(t, err)
+	require.NotEqual(t, s1, s3)
+
+	small := filepath.Join(dir, "b.txt")
+	require.NoError(t, os.WriteFile(small, []byte("hello"), 0644))
+	s4, err := fileSample(small, 5)
+	require.NoError(t, err)
+	require.Equal(t, StrMd5("hello"), s4)
+}
+
+func TestQuickSame(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "a.txt")
+	require.NoError(t, os.WriteFile(name, []byte("hello"), 0644))
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	require.NoError(t, os.Chtimes(name, mtime, mtime))
+
+	var local FileStat
+	require.NoError(t, (*hashIndex)(nil).fileGetStatCompare(name, &local, compareQuick))
+	require.Empty(t, local.Md5)
+	require.Empty(t, local.Sample)
+
+	remote := local
+	require.True(t, quickSame(&local, &remote))
+	remote.Mtime = mtime.Add(time.Second)
+	require.False(t, quickSame(&local, &remote))
+	remote = local
+	remote.Size++
+	require.False(t, quickSame(&local, &remote))
+	remote = local
+	remote.Exists = false
+	require.False(t, quickSame(&local, &remote))
+
+	require.NoError(t, (*hashIndex)(nil).fileGetStatCompare(name, &local, compareQuickSample))
+	require.Equal(t, StrMd5("hello"), local.Sample)
+	remote = local
+	remote.Sample = StrMd5("world")
+	require.False(t, quickSame(&local, &remote))
+
+	// the quick+sample differs while the quick-check passes
+	data, err := encodeManifest([]*ManifestEntry{
+		{Name: "a.txt", Size: 5, Sample: StrMd5("world"), Mode: 0644, Mtime: mtime},
+	})
+	require.NoError(t, err)
+	entries, err := decodeManifest(data)
+	require.NoError(t, err)
+	differ, err := manifestDiffer(nil, name, entries[0], compareQuick)
+	require.NoError(t, err)
+	require.False(t, differ)
+	differ, err = manifestDiffer(nil, name, entries[0], compareQuickSample)
+	require.NoError(t, err)
+	require.True(t, differ)
+}
@@ -1,6 +1,8 @@
 package internal
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"path"
 	"path/filepath"
@@ -10,7 +12,7 @@ import (
 	"github.com/golang/glog"
 )
 
-const version = "0.2.5 20220404"
+const version = "0.3.0 20261017"
 
 func GetVersion() string {
 	return version
@@ -67,3 +69,83 @@ func DemoConf(name string) string {
 	}
 	return ConfDemoClient
 }
+
+// CmdArgs a command as argv, in json it is a shell-style command line string
+// or an array of args
+type CmdArgs []string
+
+func (c *CmdArgs) UnmarshalJSON(data []byte) error {
+	var line string
+	if err := json.Unmarshal(data, &line); err != nil {
+		var args []string
+		if err = json.Unmarshal(data, &args); err != nil {
+			return fmt.Errorf("command must be a string or an array of strings: %w", err)
+		}
+		*c = args
+		return nil
+	}
+	args, err := splitShellWords(line)
+	if err != nil {
+		return fmt.Errorf("parse command %q: %w", line, err)
+	}
+	*c = args
+	return nil
+}
+
+// splitShellWords splits line into words like sh: words are separated by
+// spaces, single quotes keep everything, double quotes and backslash escape.
+// Variables and globs are not expanded.
+func splitShellWords(line string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, r := range line {
+		switch {
+		case escaped:
+			if quote == '"' && r != '"' && r != '\\' && r != '$' && r != '`' {
+				word.WriteRune('\\')
+			}
+			word.WriteRune(r)
+			escaped = false
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\\':
+			escaped = true
+			inWord = true
+		case quote == '"':
+			if r == '"' {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inWord = true
+		case r == ' ' || r == '\t' || r == '\n' || r == '\r':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if escaped {
+		return nil, errors.New("trailing backslash")
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
@@ -2,6 +2,8 @@ package internal
 
 import (
 	"testing"
+
+	"github.com/stretchr/testify/require"
 )
 
 func TestConfRegexp(t *testing.T) {
@@ -27,3 +29,23 @@ func TestConfRegexp(t *testing.T) {
 		}
 	}
 }
+
+func TestSplitShellWords(t *testing.T) {
+	cases := map[string][]string{
+		`bash deploy.sh`:                {"bash", "deploy.sh"},
+		`  bash   "my dir/deploy.sh"  `: {"bash", "my dir/deploy.sh"},
+		`sh -c 'echo "$1" $2'`:          {"sh", "-c", `echo "$1" $2`},
+		`a\ b "c\"d" "e\f" ''`:          {"a b", `c"d`, `e\f`, ""},
+		`php -l {dst}`:                  {"php", "-l", "{dst}"},
+		"x\t'y z'\"w\"":                 {"x", "y zw"},
+	}
+	for line, want := range cases {
+		got, err := splitShellWords(line)
+		require.NoError(t, err, line)
+		require.Equal(t, want, got, line)
+	}
+	for _, line := range []string{`a "b`, `a 'b`, `a\`} {
+		_, err := splitShellWords(line)
+		require.Error(t, err, line)
+	}
+}
@@ -0,0 +1,363 @@
+package internal
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+const (
+	deltaMinBlockSize = 2 << 10
+	deltaMaxBlockSize = 128 << 10
+
+	// deltaMaxLiteral flushes pending literal data into one op
+	deltaMaxLiteral = 1 << 20
+
+	// deltaMaxCopy the max length of adjacent copies merged into one op
+	deltaMaxCopy = 64 << 20
+)
+
+// BlockSig the signature of one block of the server file
+type BlockSig struct {
+	Weak   uint32
+	Strong string
+}
+
+// FileSignature the block signatures of the server file,
+// the last block may be shorter than BlockSize
+type FileSignature struct {
+	Exists    bool
+	Size      int64
+	BlockSize int64
+	Blocks    []BlockSig
+}
+
+// DeltaOp copies Len bytes at Offset of the server file when Data is empty,
+// otherwise writes the gzipped literal Data
+type DeltaOp struct {
+	Offset int64
+	Len    int64
+	Data   []byte
+}
+
+func (op *DeltaOp) isLiteral() bool {
+	return len(op.Data) > 0
+}
+
+// deltaBlockSize picks a block size about the square root of the file size
+func deltaBlockSize(size int64) int64 {
+	bs := int64(math.Sqrt(float64(size)))
+	bs = (bs + 1023) / 1024 * 1024
+	return min(max(bs, deltaMinBlockSize), deltaMaxBlockSize)
+}
+
+// rollingSum the rsync weak checksum of a window
+type rollingSum struct {
+	a, b uint32
+	n    uint32
+}
+
+func (rs *rollingSum) init(data []byte) {
+	rs.a, rs.b = 0, 0
+	rs.n = uint32(len(data))
+	for i, c := range data {
+		rs.a += uint32(c)
+		rs.b += uint32(len(data)-i) * uint32(c)
+	}
+}
+
+// roll moves the window one byte forward
+func (rs *rollingSum) roll(out byte, in byte) {
+	rs.a += uint32(in) - uint32(out)
+	rs.b += rs.a - rs.n*uint32(out)
+}
+
+func (rs *rollingSum) sum() uint32 {
+	return rs.a&0xffff | rs.b<<16
+}
+
+func blockStrong(data []byte) string {
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func fileGetSignature(name string, blockSize int64, sig *FileSignature) error {
+	f, err := os.Open(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return errors.New("not regular file")
+	}
+	if blockSize <= 0 {
+		blockSize = deltaBlockSize(info.Size())
+	}
+	sig.Exists = true
+	sig.Size = info.Size()
+	sig.BlockSize = blockSize
+	sig.Blocks = make([]BlockSig, 0, info.Size()/blockSize+1)
+	buf := make([]byte, blockSize)
+	var rs rollingSum
+	for {
+		n, err := io.ReadFull(f, buf)
+		if n > 0 {
+			rs.init(buf[:n])
+			sig.Blocks = append(sig.Blocks, BlockSig{Weak: rs.sum(), Strong: blockStrong(buf[:n])})
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// deltaWriter merges adjacent ops before passing them to emit
+type deltaWriter struct {
+	emit    func(op *DeltaOp) error
+	pending *DeltaOp
+	literal []byte
+}
+
+func (dw *deltaWriter) copyBlock(offset int64, n int64) error {
+	if err := dw.flushLiteral(); err != nil {
+		return err
+	}
+	if dw.pending != nil && dw.pending.Offset+dw.pending.Len == offset && dw.pending.Len+n <= deltaMaxCopy {
+		dw.pending.Len += n
+		return nil
+	}
+	if err := dw.flushCopy(); err != nil {
+		return err
+	}
+	dw.pending = &DeltaOp{Offset: offset, Len: n}
+	return nil
+}
+
+func (dw *deltaWriter) writeLiteral(data []byte) error {
+	if err := dw.flushCopy(); err != nil {
+		return err
+	}
+	dw.literal = append(dw.literal, data...)
+	if len(dw.literal) >= deltaMaxLiteral {
+		return dw.flushLiteral()
+	}
+	return nil
+}
+
+func (dw *deltaWriter) flushCopy() error {
+	if dw.pending == nil {
+		return nil
+	}
+	op := dw.pending
+	dw.pending = nil
+	return dw.emit(op)
+}
+
+func (dw *deltaWriter) flushLiteral() error {
+	if len(dw.literal) == 0 {
+		return nil
+	}
+	op := &DeltaOp{Len: int64(len(dw.literal)), Data: dataGzipEncode(dw.literal)}
+	dw.literal = dw.literal[:0]
+	return dw.emit(op)
+}
+
+func (dw *deltaWriter) close() error {
+	if err := dw.flushLiteral(); err != nil {
+		return err
+	}
+	return dw.flushCopy()
+}
+
+// computeDelta compares r with the signature of the server file and
+// emits the ops which rebuild r from it
+func computeDelta(r io.Reader, sig *FileSignature, emit func(op *DeltaOp) error) error {
+	dw := &deltaWriter{emit: emit}
+	bs := int(sig.BlockSize)
+	if !sig.Exists || bs <= 0 || len(sig.Blocks) == 0 {
+		buf := make([]byte, deltaMaxLiteral)
+		for {
+			n, err := io.ReadFull(r, buf)
+			if n > 0 {
+				if errW := dw.writeLiteral(buf[:n]); errW != nil {
+					return errW
+				}
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return dw.close()
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	weakIndex := make(map[uint32][]int, len(sig.Blocks))
+	for i, b := range sig.Blocks {
+		weakIndex[b.Weak] = append(weakIndex[b.Weak], i)
+	}
+	blockLen := func(i int) int {
+		if i == len(sig.Blocks)-1 {
+			return int(sig.Size - int64(i)*sig.BlockSize)
+		}
+		return bs
+	}
+	match := func(window []byte, weak uint32) int {
+		var strong string
+		for _, i := range weakIndex[weak] {
+			if blockLen(i) != len(window) {
+				continue
+			}
+			if strong == "" {
+				strong = blockStrong(window)
+			}
+			if strong == sig.Blocks[i].Strong {
+				return i
+			}
+		}
+		return -1
+	}
+
+	bufSize := max(4*bs, deltaMaxLiteral)
+	data := make([]byte, 0, bufSize+bs)
+	start, litStart := 0, 0
+	eof := false
+	fill := func() error {
+		if eof {
+			return nil
+		}
+		if litStart < start {
+			if err := dw.writeLiteral(data[litStart:start]); err != nil {
+				return err
+			}
+		}
+		n := copy(data[:cap(data)], data[start:])
+		data = data[:n]
+		start, litStart = 0, 0
+		m, err := io.ReadFull(r, data[n:cap(data)])
+		data = data[:n+m]
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			eof = true
+			return nil
+		}
+		return err
+	}
+
+	var rs rollingSum
+	rolling := false
+	for {
+		if len(data)-start <= bs && !eof {
+			if err := fill(); err != nil {
+				return err
+			}
+		}
+		remain := len(data) - start
+		if remain == 0 {
+			break
+		}
+		if remain < bs {
+			// the tail can only match the short last block
+			rs.init(data[start:])
+			if i := match(data[start:], rs.sum()); i >= 0 {
+				if litStart < start {
+					if err := dw.writeLiteral(data[litStart:start]); err != nil {
+						return err
+					}
+				}
+				if err := dw.copyBlock(int64(i)*sig.BlockSize, int64(remain)); err != nil {
+					return err
+				}
+				litStart = len(data)
+			}
+			start = len(data)
+			break
+		}
+		window := data[start : start+bs]
+		if !rolling {
+			rs.init(window)
+			rolling = true
+		}
+		if i := match(window, rs.sum()); i >= 0 {
+			if litStart < start {
+				if err := dw.writeLiteral(data[litStart:start]); err != nil {
+					return err
+				}
+			}
+			if err := dw.copyBlock(int64(i)*sig.BlockSize, int64(bs)); err != nil {
+				return err
+			}
+			start += bs
+			litStart = start
+			rolling = false
+			continue
+		}
+		if start+bs < len(data) {
+			rs.roll(data[start], data[start+bs])
+		} else {
+			// the window reaches the end of the file
+			rolling = false
+		}
+		start++
+		if start-litStart >= deltaMaxLiteral {
+			if err := dw.writeLiteral(data[litStart:start]); err != nil {
+				return err
+			}
+			litStart = start
+		}
+	}
+	if litStart < len(data) {
+		if err := dw.writeLiteral(data[litStart:]); err != nil {
+			return err
+		}
+	}
+	return dw.close()
+}
+
+// applyDelta writes the ops into w, copy ops read from base of baseSize bytes
+func applyDelta(base io.ReaderAt, baseSize int64, ops []*DeltaOp, w io.WriterAt, pos int64) (int64, error) {
+	for _, op := range ops {
+		if op.isLiteral() {
+			data, err := dataGzipDecode(op.Data)
+			if err != nil {
+				return pos, err
+			}
+			if int64(len(data)) != op.Len {
+				return pos, fmt.Errorf("delta literal length %d, want %d", len(data), op.Len)
+			}
+			if _, err := w.WriteAt(data, pos); err != nil {
+				return pos, err
+			}
+			pos += op.Len
+			continue
+		}
+		if base == nil {
+			return pos, errors.New("delta copy op without base file")
+		}
+		if op.Offset < 0 || op.Len < 0 || op.Offset > baseSize || op.Len > baseSize-op.Offset {
+			return pos, fmt.Errorf("delta copy [%d,%d] out of base size %d", op.Offset, op.Len, baseSize)
+		}
+		n, err := io.Copy(io.NewOffsetWriter(w, pos), io.NewSectionReader(base, op.Offset, op.Len))
+		if err == nil && n != op.Len {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return pos, fmt.Errorf("delta copy [%d,%d]: %w", op.Offset, op.Len, err)
+		}
+		pos += n
+	}
+	return pos, nil
+}
@@ -0,0 +1,121 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/gob"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type memWriterAt struct {
+	buf []byte
+}
+
+func (m *memWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	if end := int(off) + len(p); end > len(m.buf) {
+		m.buf = append(m.buf, make([]byte, end-len(m.buf))...)
+	}
+	return copy(m.buf[off:], p), nil
+}
+
+func TestComputeDelta(t *testing.T) {
+	rd := rand.New(rand.NewSource(1))
+	old := make([]byte, 4<<20)
+	rd.Read(old)
+	base := filepath.Join(t.TempDir(), "old.bin")
+	require.NoError(t, os.WriteFile(base, old, 0644))
+
+	var sig FileSignature
+	require.NoError(t, fileGetSignature(base, 0, &sig))
+	require.True(t, sig.Exists)
+
+	join := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+	half := len(old) / 2
+	cases := map[string][]byte{
+		"same":   old,
+		"start":  join([]byte("x"), old),
+		"middle": join(old[:half], []byte("inserted in the middle"), old[half+100:]),
+		"end":    join(old[:len(old)-10], []byte("new tail of the file")),
+		"short":  old[:12345],
+	}
+	for name, newData := range cases {
+		t.Run(name, func(t *testing.T) {
+			var ops []*DeltaOp
+			err := computeDelta(bytes.NewReader(newData), &sig, func(op *DeltaOp) error {
+				ops = append(ops, op)
+				return nil
+			})
+			require.NoError(t, err)
+
+			var wire bytes.Buffer
+			require.NoError(t, gob.NewEncoder(&wire).Encode(ops))
+			// at most a few blocks are sent as literal
+			require.Less(t, wire.Len(), 4*int(sig.BlockSize), "ops=%d", len(ops))
+			t.Logf("file size=%d, bytes on wire=%d", len(newData), wire.Len())
+
+			f, err := os.Open(base)
+			require.NoError(t, err)
+			defer f.Close()
+			w := &memWriterAt{}
+			n, err := applyDelta(f, int64(len(old)), ops, w, 0)
+			require.NoError(t, err)
+			require.Equal(t, int64(len(newData)), n)
+			require.Equal(t, newData, w.buf)
+		})
+	}
+}
+
+func TestComputeDelta_noBase(t *testing.T) {
+	data := []byte("hello world")
+	var ops []*DeltaOp
+	err := computeDelta(bytes.NewReader(data), &FileSignature{}, func(op *DeltaOp) error {
+		ops = append(ops, op)
+		return nil
+	})
+	require.NoError(t, err)
+	w := &memWriterAt{}
+	_, err = applyDelta(nil, 0, ops, w, 0)
+	require.NoError(t, err)
+	require.Equal(t, data, w.buf)
+}
+
+func TestApplyDelta_badCopy(t *testing.T) {
+	base := bytes.NewReader([]byte("0123456789"))
+	for _, op := range []*DeltaOp{
+		{Offset: 0, Len: -1},
+		{Offset: -1, Len: 2},
+		{Offset: 8, Len: 3},
+		{Offset: 11, Len: 0},
+		{Offset: 1, Len: math.MaxInt64},
+	} {
+		_, err := applyDelta(base, 10, []*DeltaOp{op}, &memWriterAt{}, 0)
+		require.Error(t, err, "op=%+v", op)
+	}
+	w := &memWriterAt{}
+	n, err := applyDelta(base, 10, []*DeltaOp{{Offset: 8, Len: 2}, {Offset: 0, Len: 3}}, w, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(5), n)
+	require.Equal(t, "89012", string(w.buf))
+}
+
+func TestDeltaWriter_copyLimit(t *testing.T) {
+	var ops []*DeltaOp
+	dw := &deltaWriter{emit: func(op *DeltaOp) error {
+		ops = append(ops, op)
+		return nil
+	}}
+	const bs = deltaMaxBlockSize
+	for i := int64(0); i < 2*deltaMaxCopy/bs; i++ {
+		require.NoError(t, dw.copyBlock(i*bs, bs))
+	}
+	require.NoError(t, dw.close())
+	require.Len(t, ops, 2)
+	require.Equal(t, &DeltaOp{Offset: deltaMaxCopy, Len: deltaMaxCopy}, ops[1])
+}
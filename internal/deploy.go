@@ -0,0 +1,305 @@
+package internal
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// the event names passed to deployCmd
+const (
+	deployUpdate = "update"
+	deployDelete = "delete"
+	deployRename = "rename"
+
+	// deployRollback a release deploy switched back to its previous release
+	deployRollback = "rollback"
+)
+
+// deployEvent a pending deploy of one file.
+// From is the old name of a rename, a delete with From also removes the old name.
+type deployEvent struct {
+	Type EventType
+	From string
+
+	// User the name of the user who made the change
+	User string
+
+	// seq orders the events, a rename must be deployed before the
+	// events of the names it moved
+	seq uint64
+}
+
+// mergeDeployEvent merges the new event ev of relName into the pending one old
+func mergeDeployEvent(old *deployEvent, ev *deployEvent) *deployEvent {
+	if old == nil || old.Type != EventRename {
+		return ev
+	}
+	switch ev.Type {
+	case EventUpdate:
+		// the file renamed is changed again, the rename still needs to be deployed
+		return old
+	case EventDelete:
+		return &deployEvent{Type: EventDelete, From: old.From, User: ev.User, seq: old.seq}
+	}
+	return ev
+}
+
+// addRenameEvent queues the rename from relNameOld to relName for deploy
+func (trans *Trans) addRenameEvent(user *ServerConfUser, relName string, relNameOld string) {
+	if !user.can(permDeploy) {
+		glog.V(2).Infoln("user", user.Name, "has no deploy perm, skip event", relName)
+		return
+	}
+	trans.mu.Lock()
+	defer trans.mu.Unlock()
+	ev := &deployEvent{Type: EventRename, From: relNameOld, User: user.Name}
+	if old := trans.events[relNameOld]; old != nil {
+		delete(trans.events, relNameOld)
+		switch old.Type {
+		case EventRename:
+			// renamed again before deployed
+			ev.From = old.From
+		case EventUpdate:
+			// not deployed yet, deploy it as the new name
+			trans.putEvent(relNameOld, &deployEvent{Type: EventDelete, User: user.Name})
+			ev = &deployEvent{Type: EventUpdate, User: user.Name}
+		}
+	}
+	trans.putEvent(relName, ev)
+
+	// the pending events under a renamed dir are deployed after it with the new names
+	prefix := relNameOld + string(filepath.Separator)
+	for _, name := range sortedEvents(trans.events) {
+		child := trans.events[name]
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		delete(trans.events, name)
+		if strings.HasPrefix(child.From, prefix) {
+			child.From = filepath.Join(relName, strings.TrimPrefix(child.From, prefix))
+		}
+		trans.putEvent(filepath.Join(relName, strings.TrimPrefix(name, prefix)), child)
+	}
+}
+
+// putEvent merges ev into the events, trans.mu must be locked
+func (trans *Trans) putEvent(relName string, ev *deployEvent) {
+	now := time.Now()
+	if len(trans.events) == 0 {
+		trans.firstEvent = now
+	}
+	trans.lastActive = now
+	trans.eventSeq++
+	ev.seq = trans.eventSeq
+	trans.events[relName] = mergeDeployEvent(trans.events[relName], ev)
+}
+
+// touchEvents delays the deploy of the pending events while a file is being received
+func (trans *Trans) touchEvents() {
+	trans.mu.Lock()
+	defer trans.mu.Unlock()
+	trans.lastActive = time.Now()
+}
+
+// flushEvents asks eventLoop to deploy the pending events now
+func (trans *Trans) flushEvents() {
+	select {
+	case trans.flush <- struct{}{}:
+	default:
+	}
+}
+
+// eventsReady reports whether the pending events should be deployed at now:
+// forced, nothing received for settle, or the oldest one waited for maxWait
+func (trans *Trans) eventsReady(now time.Time, settle time.Duration, maxWait time.Duration, force bool) bool {
+	trans.mu.RLock()
+	defer trans.mu.RUnlock()
+	if len(trans.events) == 0 {
+		return false
+	}
+	if force || now.Sub(trans.lastActive) >= settle {
+		return true
+	}
+	return maxWait > 0 && now.Sub(trans.firstEvent) >= maxWait
+}
+
+// sortedEvents returns the names of events in the order they happened
+func sortedEvents(events map[string]*deployEvent) []string {
+	names := make([]string, 0, len(events))
+	for name := range events {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return events[names[i]].seq < events[names[j]].seq
+	})
+	return names
+}
+
+// deployJob one deploy of src to dst
+type deployJob struct {
+	Deploy *ServerConfDeploy
+	Dst    string
+	Src    string
+	Event  string
+
+	// OldDst the dst before a rename
+	OldDst string
+
+	// Client the user whose change triggered the deploy
+	Client string
+
+	// Release the dir of the release deployed, for a release deploy
+	Release string
+
+	// onResult is called with the result of the deployCmd
+	onResult func(res *deployResult)
+}
+
+// dealEvent mirrors the event of relName into every deploy target but the
+// release ones, which are built by deployReleases. The jobs done are returned.
+func (server *HSyncServer) dealEvent(relName string, ev *deployEvent) (done []*deployJob) {
+	add := func(job *deployJob) {
+		if job != nil {
+			done = append(done, job)
+		}
+	}
+	for _, deploy := range server.conf.Deploy {
+		if deploy.Release {
+			continue
+		}
+		dst, ok := server.conf.deployTarget(deploy, relName)
+		var oldDst string
+		var hasOld bool
+		if ev.From != "" {
+			oldDst, hasOld = server.conf.deployTarget(deploy, ev.From)
+		}
+		if !ok && !hasOld {
+			continue
+		}
+		glog.Infoln("trans.eventLoop deploy", relName, "-->", dst, "event", ev.Type, "from", ev.From)
+		job := &deployJob{Deploy: deploy, Dst: dst, Src: relName, Event: deployUpdate, Client: ev.User}
+		oldJob := &deployJob{Deploy: deploy, Dst: oldDst, Src: ev.From, Event: deployDelete, Client: ev.User}
+		switch {
+		case ev.Type == EventDelete:
+			if hasOld {
+				add(server.deployDelete(oldJob))
+			}
+			if ok {
+				job.Event = deployDelete
+				add(server.deployDelete(job))
+			}
+		case ev.Type == EventRename && ok && hasOld:
+			job.Event, job.OldDst = deployRename, oldDst
+			add(server.deployRename(job))
+		case ev.Type == EventRename && hasOld:
+			// moved out of the deploy from dir
+			add(server.deployDelete(oldJob))
+		case ok:
+			add(server.deploy(job))
+		}
+	}
+	return done
+}
+
+// deployDelete removes job.Dst unless the deploy keeps deletes,
+// job is returned when it is done
+func (server *HSyncServer) deployDelete(job *deployJob) *deployJob {
+	if job.Deploy.KeepDeletes {
+		glog.Infof("deploy Delete [%s] skipped, keepDeletes", job.Dst)
+		return nil
+	}
+	os.Chdir(server.conf.Home)
+	err := os.RemoveAll(job.Dst)
+	glog.Infof("deploy Delete [%s],err=%v", job.Dst, err)
+	if err != nil {
+		return nil
+	}
+	server.runDeployCmd(job)
+	return job
+}
+
+// deployRename moves job.OldDst to job.Dst, a file is copied again since it may be
+// changed after renamed. The old one is kept when the deploy keeps deletes.
+// The job done is returned, it is an update when the old one is not moved.
+func (server *HSyncServer) deployRename(job *deployJob) *deployJob {
+	os.Chdir(server.conf.Home)
+	update := &deployJob{Deploy: job.Deploy, Dst: job.Dst, Src: job.Src, Event: deployUpdate, Client: job.Client}
+	info, err := os.Lstat(job.OldDst)
+	if err != nil || job.Deploy.KeepDeletes {
+		return server.deploy(update)
+	}
+	if err = checkDir(filepath.Dir(job.Dst), 0755); err == nil {
+		os.RemoveAll(job.Dst)
+		err = os.Rename(job.OldDst, job.Dst)
+	}
+	glog.Infof("deploy Rename [%s]->[%s],err=%v", job.OldDst, job.Dst, err)
+	if err != nil {
+		return server.deploy(update)
+	}
+	if !info.IsDir() {
+		if err = copyFileSkip(job.Dst, job.Src, nil); err != nil {
+			glog.Warningf("deploy Copy [%s]->[%s],err=%v", job.Src, job.Dst, err)
+			return nil
+		}
+	}
+	server.runDeployCmd(job)
+	return job
+}
+
+// deployCmdVars the placeholders of deployCmd, also exported as HSYNC_* env
+func (server *HSyncServer) deployCmdVars(job *deployJob) map[string]string {
+	return map[string]string{
+		"dst":         job.Dst,
+		"src":         job.Src,
+		"event":       job.Event,
+		"old_dst":     job.OldDst,
+		"home":        server.conf.Home,
+		"deploy_from": job.Deploy.From,
+		"deploy_to":   job.Deploy.To,
+		"client":      job.Client,
+		"release":     job.Release,
+		"pwd":         server.conf.ConfDir,
+	}
+}
+
+var deployCmdVarReg = regexp.MustCompile(`\{([a-z_]+)\}`)
+
+// expandDeployCmd replaces the placeholders in args, unknown ones are kept.
+// named reports whether a placeholder other than {pwd} is used.
+func expandDeployCmd(args []string, vars map[string]string) (expanded []string, named bool) {
+	expanded = make([]string, len(args))
+	for i, arg := range args {
+		expanded[i] = deployCmdVarReg.ReplaceAllStringFunc(arg, func(m string) string {
+			name := m[1 : len(m)-1]
+			v, has := vars[name]
+			if !has {
+				return m
+			}
+			if name != "pwd" {
+				named = true
+			}
+			return v
+		})
+	}
+	return expanded, named
+}
+
+// deployCmdEnv the env of deployCmd: the server env, HSYNC_* vars then deploy.Env
+func deployCmdEnv(vars map[string]string, env map[string]string) []string {
+	cmdEnv := os.Environ()
+	for _, k := range slices.Sorted(maps.Keys(vars)) {
+		cmdEnv = append(cmdEnv, "HSYNC_"+strings.ToUpper(k)+"="+vars[k])
+	}
+	for _, k := range slices.Sorted(maps.Keys(env)) {
+		cmdEnv = append(cmdEnv, k+"="+env[k])
+	}
+	return cmdEnv
+}
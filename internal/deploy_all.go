@@ -0,0 +1,385 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/golang/glog"
+)
+
+// DeploySummary the counts of a full deploy
+type DeploySummary struct {
+	Copied  atomic.Int64
+	Skipped atomic.Int64
+	Deleted atomic.Int64
+	Failed  atomic.Int64
+}
+
+func (s *DeploySummary) String() string {
+	return fmt.Sprintf("copied=%d, skipped=%d, deleted=%d, failed=%d", s.Copied.Load(), s.Skipped.Load(), s.Deleted.Load(), s.Failed.Load())
+}
+
+// DeployOptions the options of DeployAll
+type DeployOptions struct {
+	// DryRun only plans the actions without touching disk
+	DryRun bool
+
+	// Out receives the actions, one per line
+	Out io.Writer
+
+	// Only restricts the deploy to these paths, each one is a path under home,
+	// which selects the entries whose from contains it and only deploys it,
+	// or the from or to of an entry, which selects the whole entry.
+	// A release entry selected is always deployed in whole.
+	Only []string
+}
+
+func (opts *DeployOptions) printf(format string, args ...any) {
+	if opts.Out != nil {
+		io.WriteString(opts.Out, fmt.Sprintf(format, args...))
+	}
+}
+
+// lockedWriter serializes the lines printed by the deploy workers
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (lw *lockedWriter) Write(p []byte) (int, error) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	return lw.w.Write(p)
+}
+
+// deployScopes returns the sub paths of dc's from to deploy, "." is all of it,
+// no scope means the entry is not selected by opts.Only
+func (opts *DeployOptions) deployScopes(dc *ServerConfDeploy) []string {
+	if len(opts.Only) == 0 {
+		return []string{"."}
+	}
+	from := filepath.Clean(dc.From)
+	var scopes []string
+	for _, only := range opts.Only {
+		if filepath.Clean(only) == filepath.Clean(dc.To) {
+			return []string{"."}
+		}
+		only = filepath.Clean(strings.TrimLeft(only, "/"))
+		switch {
+		case isSubPath(only, from):
+			return []string{"."}
+		case isSubPath(from, only):
+			rel, err := filepath.Rel(from, only)
+			if err == nil {
+				scopes = append(scopes, rel)
+			}
+		}
+	}
+	if dc.Release && len(scopes) > 0 {
+		return []string{"."}
+	}
+	return scopes
+}
+
+// DeployAll deploys every entry in full: only the files whose size or hash
+// differ are copied, by DeployWorkers at the same time, and the extraneous
+// files are removed for the mirror entries. The failed deployCmds are counted too.
+func (server *HSyncServer) DeployAll(opts DeployOptions) *DeploySummary {
+	glog.Infoln("deploy all start, dry run:", opts.DryRun, "only:", opts.Only)
+	if opts.Out != nil {
+		opts.Out = &lockedWriter{w: opts.Out}
+	}
+	summary := &DeploySummary{}
+	var done []*deployJob
+	for _, dc := range server.conf.Deploy {
+		for _, scope := range opts.deployScopes(dc) {
+			jobs, job := server.deployFull(dc, scope, summary, &opts)
+			if job == nil {
+				continue
+			}
+			done = append(done, jobs...)
+			if opts.DryRun {
+				if cmdArgs, _ := server.deployCmdArgs(job); len(cmdArgs) > 0 {
+					opts.printf("cmd     %q\n", cmdArgs)
+				}
+				continue
+			}
+			job.onResult = func(res *deployResult) {
+				if res.Err != "" {
+					summary.Failed.Add(1)
+				}
+			}
+			server.runDeployCmd(job)
+		}
+	}
+	if opts.DryRun {
+		if len(server.conf.BatchDeployCmd) > 0 && len(done) > 0 {
+			opts.printf("batch   %q with %d files\n", []string(server.conf.BatchDeployCmd), len(done))
+		}
+	} else {
+		server.runBatchDeployCmd(done)
+		server.runner.wait()
+	}
+	glog.Infoln("deploy all done,", summary.String())
+	return summary
+}
+
+// deployFull copies the files under scope of dc's from which differ from
+// their target, the jobs of the files copied and deleted are returned with
+// the job of the whole scope, which is nil when scope is not deployed.
+// A release entry is built into a new release, which becomes the current one.
+func (server *HSyncServer) deployFull(dc *ServerConfDeploy, scope string, summary *DeploySummary, opts *DeployOptions) ([]*deployJob, *deployJob) {
+	src := filepath.Join(dc.From, scope)
+	dst, ok := server.conf.deployTarget(dc, src)
+	if !ok {
+		glog.Infof("deploy [%s] is not deployed by [%s]", src, dc.key())
+		return nil, nil
+	}
+	opts.printf("deploy  %s -> %s\n", src, dst)
+	srcRoot := server.conf.homePath(src)
+	dstRoot := server.conf.homePath(dst)
+	// prevRoot the current release the files unchanged are linked from
+	var prevRoot string
+	var next *release
+	if dc.Release {
+		var err error
+		if next, err = server.newRelease(dc, opts.DryRun); err != nil {
+			glog.Warningf("deploy [%s] new release failed: %v", dc.key(), err)
+			opts.printf("fail    %s: %v\n", dc.To, err)
+			summary.Failed.Add(1)
+			return nil, nil
+		}
+		opts.printf("release %s\n", filepath.Join(dc.To, releasesDir, next.Name))
+		dstRoot, prevRoot = next.Dir, next.Prev
+	}
+	var jobs []*deployJob
+	var mu sync.Mutex
+	addJob := func(event string, rel string) {
+		mu.Lock()
+		defer mu.Unlock()
+		jobs = append(jobs, &deployJob{Deploy: dc, Event: event, Src: filepath.Join(src, rel), Dst: filepath.Join(dst, rel)})
+	}
+	var failed atomic.Bool
+	fail := func(name string, err error) {
+		glog.Warningf("deploy [%s] failed: %v", name, err)
+		opts.printf("fail    %s: %v\n", name, err)
+		summary.Failed.Add(1)
+		failed.Store(true)
+	}
+
+	sem := make(chan struct{}, max(server.conf.DeployWorkers, 1))
+	var wg sync.WaitGroup
+	// the names under srcRoot deployed, the others are extraneous for mirror
+	seen := make(map[string]bool)
+	err := filepath.WalkDir(srcRoot, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			fail(path, err)
+			return nil
+		}
+		rel, err := filepath.Rel(srcRoot, path)
+		if err != nil {
+			return err
+		}
+		if isUploadTmp(path) || isSubPath(server.conf.StateDir, path) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if rel != "." && !dc.match(filepath.Join(src, rel), d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		seen[rel] = true
+		dstName := filepath.Join(dstRoot, rel)
+		if d.IsDir() {
+			if opts.DryRun {
+				if _, err := os.Lstat(dstName); err != nil && next == nil {
+					opts.printf("mkdir   %s\n", filepath.Join(dst, rel))
+				}
+				return nil
+			}
+			info, err := d.Info()
+			if err == nil {
+				err = checkDir(dstName, info.Mode().Perm())
+			}
+			if err != nil {
+				fail(path, err)
+			}
+			return nil
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			var prev string
+			if prevRoot != "" {
+				prev = filepath.Join(prevRoot, rel)
+			}
+			copied, err := server.deployFile(dstName, path, prev, opts.DryRun)
+			switch {
+			case err != nil:
+				fail(path, err)
+			case copied:
+				summary.Copied.Add(1)
+				addJob(deployUpdate, rel)
+				opts.printf("copy    %s -> %s\n", filepath.Join(src, rel), filepath.Join(dst, rel))
+			default:
+				summary.Skipped.Add(1)
+			}
+		}()
+		return nil
+	})
+	wg.Wait()
+	if err != nil {
+		fail(srcRoot, err)
+	}
+	if next != nil {
+		return server.finishRelease(dc, next, seen, summary, opts, failed.Load(), jobs)
+	}
+	if err != nil {
+		return jobs, nil
+	}
+	if dc.Mirror {
+		server.deployMirror(dc, src, dst, dstRoot, seen, summary, opts, addJob)
+	}
+	return jobs, &deployJob{Deploy: dc, Dst: dst, Src: src, Event: deployUpdate}
+}
+
+// deployFile copies src to dst when they differ in type, size or md5,
+// only the comparison is done when dryRun. With prev, src is compared with
+// prev instead, and prev is linked as dst when they are the same.
+func (server *HSyncServer) deployFile(dst string, src string, prev string, dryRun bool) (copied bool, err error) {
+	srcInfo, err := os.Lstat(src)
+	if err != nil {
+		return false, err
+	}
+	old := dst
+	if prev != "" {
+		old = prev
+	}
+	oldInfo, errOld := os.Lstat(old)
+	if srcInfo.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(src)
+		if err != nil {
+			return false, err
+		}
+		if oldTarget, err := os.Readlink(old); err == nil && oldTarget == target {
+			if prev == "" || dryRun {
+				return false, nil
+			}
+			return false, copySymlink(dst, src)
+		}
+		if dryRun {
+			return true, nil
+		}
+		return true, copySymlink(dst, src)
+	}
+	if !srcInfo.Mode().IsRegular() {
+		return false, nil
+	}
+	var index *hashIndex
+	if server.trans != nil {
+		index = server.trans.index
+	}
+	srcMd5 := index.fileMd5(src, srcInfo)
+	if errOld == nil && oldInfo.Mode().IsRegular() && oldInfo.Size() == srcInfo.Size() &&
+		(prev != "" && oldInfo.ModTime().Equal(srcInfo.ModTime()) || FileMd5(old) == srcMd5) {
+		if prev == "" || dryRun {
+			return false, nil
+		}
+		if err = os.Link(prev, dst); err == nil {
+			return false, nil
+		}
+		glog.V(2).Infof("deploy link [%s] failed, copy it: %v", prev, err)
+	}
+	if dryRun {
+		return true, nil
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	return true, replaceFile(dst, f, &FileStat{FileMode: srcInfo.Mode(), Md5: srcMd5, Mtime: srcInfo.ModTime()})
+}
+
+// deployMirror removes the files under dstRoot, which is dst on disk, that are
+// not deployed from src, the ones filtered out by the deploy are kept.
+// For a release entry dstRoot is the previous release, the files are only counted.
+func (server *HSyncServer) deployMirror(dc *ServerConfDeploy, src string, dst string, dstRoot string, seen map[string]bool, summary *DeploySummary, opts *DeployOptions, addJob func(event string, rel string)) {
+	filepath.WalkDir(dstRoot, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(dstRoot, path)
+		if err != nil || seen[rel] {
+			return nil
+		}
+		if !dc.Release && !dc.match(filepath.Join(src, rel), d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if opts.DryRun {
+			opts.printf("delete  %s\n", filepath.Join(dst, rel))
+		} else if !dc.Release {
+			if err = os.RemoveAll(path); err != nil {
+				glog.Warningf("deploy mirror remove [%s] failed: %v", path, err)
+				summary.Failed.Add(1)
+				return nil
+			}
+			glog.Infof("deploy mirror removed [%s]", path)
+		}
+		summary.Deleted.Add(1)
+		addJob(deployDelete, rel)
+		if d.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
+
+// finishRelease switches the current of dc to rel when it is built without
+// failure and removes the old releases, a failed one is removed instead
+func (server *HSyncServer) finishRelease(dc *ServerConfDeploy, rel *release, seen map[string]bool, summary *DeploySummary, opts *DeployOptions, failed bool, jobs []*deployJob) ([]*deployJob, *deployJob) {
+	if failed {
+		if !opts.DryRun {
+			os.RemoveAll(rel.Dir)
+		}
+		return nil, nil
+	}
+	var mu sync.Mutex
+	if rel.Prev != "" {
+		server.deployMirror(dc, dc.From, dc.current(), rel.Prev, seen, summary, opts, func(event string, name string) {
+			mu.Lock()
+			defer mu.Unlock()
+			jobs = append(jobs, &deployJob{Deploy: dc, Event: event, Src: filepath.Join(dc.From, name), Dst: filepath.Join(dc.current(), name)})
+		})
+	}
+	release := filepath.Join(dc.To, releasesDir, rel.Name)
+	opts.printf("switch  %s -> %s\n", dc.current(), release)
+	if !opts.DryRun {
+		if err := server.switchRelease(dc, rel.Name); err != nil {
+			glog.Warningf("deploy [%s] switch release failed: %v", dc.key(), err)
+			opts.printf("fail    %s: %v\n", dc.current(), err)
+			summary.Failed.Add(1)
+			os.RemoveAll(rel.Dir)
+			return nil, nil
+		}
+		server.pruneReleases(dc)
+	}
+	return jobs, &deployJob{Deploy: dc, Dst: dc.current(), Src: dc.From, Event: deployUpdate, Release: release}
+}
@@ -0,0 +1,104 @@
+package internal
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHSyncServer_DeployAll(t *testing.T) {
+	home := testHome(t)
+	writeTestFile(t, home, "src/a.txt", "a")
+	writeTestFile(t, home, "src/sub/b.txt", "b")
+	writeTestFile(t, home, "src/c.map", "c")
+	require.NoError(t, os.Symlink("a.txt", filepath.Join(home, "src", "l.txt")))
+	mirror := &ServerConfDeploy{From: "src", To: "out1", Mirror: true, Ignore: []string{"*.map"}}
+	grow := &ServerConfDeploy{From: "src", To: "out2"}
+	require.NoError(t, mirror.parse())
+	require.NoError(t, grow.parse())
+	server := &HSyncServer{conf: &ServerConf{
+		Home:          home,
+		StateDir:      filepath.Join(home, ".hsyncd"),
+		DeployWorkers: 2,
+		Deploy:        []*ServerConfDeploy{mirror, grow},
+	}}
+
+	summary := server.DeployAll(DeployOptions{})
+	require.Equal(t, "copied=7, skipped=0, deleted=0, failed=0", summary.String())
+	require.Equal(t, "b", readTestFile(home, "out1/sub/b.txt"))
+	require.Empty(t, readTestFile(home, "out1/c.map"))
+	require.Equal(t, "c", readTestFile(home, "out2/c.map"))
+	link, err := os.Readlink(filepath.Join(home, "out1", "l.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "a.txt", link)
+
+	// unchanged files are not copied again, the extraneous ones are removed from the mirror
+	old := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(filepath.Join(home, "out1", "a.txt"), old, old))
+	writeTestFile(t, home, "src/a.txt", "A")
+	require.NoError(t, os.Remove(filepath.Join(home, "src", "sub", "b.txt")))
+	writeTestFile(t, home, "out1/extra/x.txt", "x")
+	writeTestFile(t, home, "out1/keep.map", "k")
+	summary = server.DeployAll(DeployOptions{})
+	require.Equal(t, "copied=2, skipped=3, deleted=2, failed=0", summary.String())
+	require.Equal(t, "A", readTestFile(home, "out1/a.txt"))
+	require.Empty(t, readTestFile(home, "out1/sub/b.txt"))
+	require.Empty(t, readTestFile(home, "out1/extra/x.txt"))
+	require.Equal(t, "k", readTestFile(home, "out1/keep.map"))
+	require.Equal(t, "b", readTestFile(home, "out2/sub/b.txt"))
+
+	// the target is a file where a dir is expected
+	require.NoError(t, os.RemoveAll(filepath.Join(home, "out2", "sub")))
+	writeTestFile(t, home, "out2/sub", "file")
+	writeTestFile(t, home, "src/sub/d.txt", "d")
+	summary = server.DeployAll(DeployOptions{})
+	require.Positive(t, summary.Failed.Load())
+}
+
+func TestHSyncServer_DeployAllDryRunOnly(t *testing.T) {
+	home := testHome(t)
+	for _, name := range []string{"static/js/a.js", "static/css/b.css", "out/js/old.js"} {
+		writeTestFile(t, home, name, name)
+	}
+	static := &ServerConfDeploy{From: "static", To: "out", Mirror: true, DeployCmd: CmdArgs{"touch", "{dst}.done"}}
+	other := &ServerConfDeploy{From: "php", To: "app"}
+	server := &HSyncServer{conf: &ServerConf{
+		Home:          home,
+		StateDir:      filepath.Join(home, ".hsyncd"),
+		DeployWorkers: 2,
+		Deploy:        []*ServerConfDeploy{static, other},
+	}}
+
+	opts := &DeployOptions{Only: []string{"static/js/"}}
+	require.Equal(t, []string{"js"}, opts.deployScopes(static))
+	require.Empty(t, opts.deployScopes(other))
+	opts.Only = []string{"out/"}
+	require.Equal(t, []string{"."}, opts.deployScopes(static))
+	opts.Only = nil
+	require.Equal(t, []string{"."}, opts.deployScopes(other))
+
+	var out bytes.Buffer
+	summary := server.DeployAll(DeployOptions{DryRun: true, Out: &out, Only: []string{"static/js"}})
+	require.Equal(t, "copied=1, skipped=0, deleted=1, failed=0", summary.String())
+	require.Equal(t, strings.Join([]string{
+		"deploy  static/js -> out/js",
+		"copy    static/js/a.js -> out/js/a.js",
+		"delete  out/js/old.js",
+		`cmd     ["touch" "out/js.done"]`,
+		"",
+	}, "\n"), out.String())
+	require.NoFileExists(t, filepath.Join(home, "out", "js", "a.js"))
+	require.FileExists(t, filepath.Join(home, "out", "js", "old.js"))
+
+	summary = server.DeployAll(DeployOptions{Only: []string{"static/js"}})
+	require.Equal(t, "copied=1, skipped=0, deleted=1, failed=0", summary.String())
+	require.FileExists(t, filepath.Join(home, "out", "js", "a.js"))
+	require.NoFileExists(t, filepath.Join(home, "out", "js", "old.js"))
+	require.FileExists(t, filepath.Join(home, "out", "js.done"))
+	require.NoDirExists(t, filepath.Join(home, "out", "css"))
+}
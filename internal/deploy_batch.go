@@ -0,0 +1,117 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+
+	"github.com/golang/glog"
+)
+
+// the formats of the file list given to batchDeployCmd
+const (
+	// batchDeployJSON a json array of deployRecord
+	batchDeployJSON = "json"
+
+	// batchDeployLines one "event\tsrc\tdst" per line
+	batchDeployLines = "lines"
+)
+
+// batchDeployKey the key of the batchDeployCmd results in the status
+const batchDeployKey = "batchDeployCmd"
+
+// deployRecord one file deployed, given to batchDeployCmd
+type deployRecord struct {
+	Event  string `json:"event"`
+	Src    string `json:"src"`
+	Dst    string `json:"dst"`
+	OldDst string `json:"old_dst,omitempty"`
+	To     string `json:"deploy_to"`
+	Client string `json:"client,omitempty"`
+}
+
+// encodeDeployRecords encodes the jobs done as the records of format
+func encodeDeployRecords(jobs []*deployJob, format string) ([]byte, error) {
+	if format == batchDeployLines {
+		var buf bytes.Buffer
+		for _, job := range jobs {
+			fmt.Fprintf(&buf, "%s\t%s\t%s\n", job.Event, job.Src, job.Dst)
+		}
+		return buf.Bytes(), nil
+	}
+	records := make([]*deployRecord, 0, len(jobs))
+	for _, job := range jobs {
+		records = append(records, &deployRecord{
+			Event:  job.Event,
+			Src:    job.Src,
+			Dst:    job.Dst,
+			OldDst: job.OldDst,
+			To:     job.Deploy.To,
+			Client: job.Client,
+		})
+	}
+	return json.Marshal(records)
+}
+
+// runBatchDeployCmd runs batchDeployCmd once for the jobs done in one flush of
+// the events, after their deployCmds. The records are written to its stdin and
+// to a temp file, whose path is appended when no placeholder other than {pwd} is used.
+func (server *HSyncServer) runBatchDeployCmd(jobs []*deployJob) {
+	if len(server.conf.BatchDeployCmd) == 0 || len(jobs) == 0 {
+		return
+	}
+	data, err := encodeDeployRecords(jobs, server.conf.BatchDeployFormat)
+	if err != nil {
+		glog.Warningln("encode batch deploy records failed:", err)
+		return
+	}
+	f, err := os.CreateTemp("", "hsync-batch-*."+server.conf.BatchDeployFormat)
+	if err != nil {
+		glog.Warningln("create batch deploy file failed:", err)
+		return
+	}
+	_, err = f.Write(data)
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		glog.Warningln("write batch deploy records failed:", err)
+		os.Remove(f.Name())
+		return
+	}
+
+	vars := map[string]string{
+		"file":  f.Name(),
+		"count": strconv.Itoa(len(jobs)),
+		"home":  server.conf.Home,
+		"pwd":   server.conf.ConfDir,
+	}
+	cmdArgs, named := expandDeployCmd(server.conf.BatchDeployCmd, vars)
+	if !named {
+		cmdArgs = append(cmdArgs, f.Name())
+	}
+	env := deployCmdEnv(map[string]string{"batch_file": f.Name(), "batch_count": vars["count"], "home": vars["home"], "pwd": vars["pwd"]}, nil)
+	newCmd := func(ctx context.Context) *exec.Cmd {
+		cmd := exec.CommandContext(ctx, cmdArgs[0], cmdArgs[1:]...)
+		cmd.Dir = server.conf.Home
+		cmd.Env = env
+		cmd.Stdin = bytes.NewReader(data)
+		return cmd
+	}
+	job := &deployJob{Deploy: &ServerConfDeploy{}, Event: "batch", Src: vars["count"] + " files", Dst: f.Name()}
+
+	// the deployCmds of the jobs run first, the caller is not blocked by them
+	server.runner.after(func() {
+		server.runner.submit(batchDeployKey, func() {
+			defer os.Remove(f.Name())
+			res := server.execDeployCmd(job, newCmd)
+			if server.trans != nil {
+				server.trans.stats.addDeployResult(batchDeployKey, res, server.conf.DeployResults)
+			}
+		})
+	})
+}
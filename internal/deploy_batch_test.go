@@ -0,0 +1,58 @@
+package internal
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHSyncServer_runBatchDeployCmd(t *testing.T) {
+	home := t.TempDir()
+	deploy := &ServerConfDeploy{From: "a", To: "d"}
+	jobs := []*deployJob{
+		{Deploy: deploy, Event: deployUpdate, Src: "a/x", Dst: "d/x", Client: "tom"},
+		{Deploy: deploy, Event: deployRename, Src: "a/z", Dst: "d/z", OldDst: "d/y"},
+	}
+
+	server := &HSyncServer{
+		conf: &ServerConf{
+			Home:              home,
+			BatchDeployCmd:    CmdArgs{"sh", "-c", `cat > stdin.txt; cp "$0" file.txt; echo "$HSYNC_BATCH_COUNT" > count.txt`},
+			BatchDeployFormat: batchDeployJSON,
+		},
+		runner: newDeployRunner(2),
+	}
+	server.runBatchDeployCmd(jobs)
+	server.runner.wait()
+	stdin, err := os.ReadFile(filepath.Join(home, "stdin.txt"))
+	require.NoError(t, err)
+	file, err := os.ReadFile(filepath.Join(home, "file.txt"))
+	require.NoError(t, err)
+	require.Equal(t, stdin, file)
+	var records []*deployRecord
+	require.NoError(t, json.Unmarshal(stdin, &records))
+	require.Equal(t, []*deployRecord{
+		{Event: deployUpdate, Src: "a/x", Dst: "d/x", To: "d", Client: "tom"},
+		{Event: deployRename, Src: "a/z", Dst: "d/z", OldDst: "d/y", To: "d"},
+	}, records)
+	count, err := os.ReadFile(filepath.Join(home, "count.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "2\n", string(count))
+
+	server.conf.BatchDeployFormat = batchDeployLines
+	server.conf.BatchDeployCmd = CmdArgs{"sh", "-c", "cat > lines.txt; test -e {file}"}
+	server.runBatchDeployCmd(jobs)
+	server.runner.wait()
+	lines, err := os.ReadFile(filepath.Join(home, "lines.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "update\ta/x\td/x\nrename\ta/z\td/z\n", string(lines))
+
+	// nothing deployed
+	require.NoError(t, os.Remove(filepath.Join(home, "lines.txt")))
+	server.runBatchDeployCmd(nil)
+	server.runner.wait()
+	require.NoFileExists(t, filepath.Join(home, "lines.txt"))
+}
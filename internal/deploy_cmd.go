@@ -0,0 +1,204 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// deployOutputMax the bytes of the deployCmd output kept in a deployResult
+	deployOutputMax = 4 << 10
+
+	// deployBackoffMax the max wait between two retries of a deployCmd
+	deployBackoffMax = 30 * time.Second
+)
+
+// deployResult the result of one deployCmd run, kept for the status page
+type deployResult struct {
+	Time     time.Time
+	Event    string
+	Dst      string
+	Src      string
+	ExitCode int
+	Duration string
+	Attempts int
+	Err      string `json:",omitempty"`
+	Output   string `json:",omitempty"`
+}
+
+// deployRunner runs the deployCmds in a bounded pool of workers,
+// the commands of the same key run in order on the same worker.
+// A nil *deployRunner runs them at once.
+type deployRunner struct {
+	queues []*deployQueue
+	wg     sync.WaitGroup
+}
+
+// deployQueue the commands waiting for one worker, it is not bounded
+// so that submitting never blocks the event loop
+type deployQueue struct {
+	mu    sync.Mutex
+	fns   []func()
+	ready chan struct{}
+}
+
+func (q *deployQueue) push(fn func()) {
+	q.mu.Lock()
+	q.fns = append(q.fns, fn)
+	q.mu.Unlock()
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (q *deployQueue) pop() func() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.fns) == 0 {
+		return nil
+	}
+	fn := q.fns[0]
+	q.fns[0] = nil
+	q.fns = q.fns[1:]
+	return fn
+}
+
+func newDeployRunner(workers int) *deployRunner {
+	r := &deployRunner{queues: make([]*deployQueue, workers)}
+	for i := range r.queues {
+		r.queues[i] = &deployQueue{ready: make(chan struct{}, 1)}
+		go r.work(r.queues[i])
+	}
+	return r
+}
+
+func (r *deployRunner) work(queue *deployQueue) {
+	for range queue.ready {
+		for fn := queue.pop(); fn != nil; fn = queue.pop() {
+			fn()
+			r.wg.Done()
+		}
+	}
+}
+
+// submit queues fn on the worker of key without blocking
+func (r *deployRunner) submit(key string, fn func()) {
+	if r == nil {
+		fn()
+		return
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	r.wg.Add(1)
+	r.queues[h.Sum32()%uint32(len(r.queues))].push(fn)
+}
+
+// after runs fn once the commands submitted before it are done, without blocking
+func (r *deployRunner) after(fn func()) {
+	if r == nil {
+		fn()
+		return
+	}
+	var pending sync.WaitGroup
+	pending.Add(len(r.queues))
+	r.wg.Add(len(r.queues) + 1)
+	for _, queue := range r.queues {
+		queue.push(pending.Done)
+	}
+	go func() {
+		defer r.wg.Done()
+		pending.Wait()
+		fn()
+	}()
+}
+
+// wait waits for the commands submitted
+func (r *deployRunner) wait() {
+	if r != nil {
+		r.wg.Wait()
+	}
+}
+
+// limitWriter keeps the first max bytes written to it
+type limitWriter struct {
+	buf       []byte
+	max       int
+	truncated bool
+}
+
+func (w *limitWriter) Write(p []byte) (int, error) {
+	if n := w.max - len(w.buf); n < len(p) {
+		w.truncated = true
+		w.buf = append(w.buf, p[:max(n, 0)]...)
+	} else {
+		w.buf = append(w.buf, p...)
+	}
+	return len(p), nil
+}
+
+func (w *limitWriter) String() string {
+	if w.truncated {
+		return string(w.buf) + "...(truncated)"
+	}
+	return string(w.buf)
+}
+
+// execDeployCmd runs newCmd until it succeeds or the retries are used up,
+// waiting longer after each failure
+func (server *HSyncServer) execDeployCmd(job *deployJob, newCmd func(ctx context.Context) *exec.Cmd) *deployResult {
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		res := server.execDeployCmdOnce(job, newCmd)
+		res.Attempts = attempt
+		if res.Err == "" || attempt > server.conf.DeployRetries {
+			return res
+		}
+		glog.Warningf("deployCmd %s [%s]->[%s] failed, retry in %s, err=%s", job.Event, job.Src, job.Dst, backoff, res.Err)
+		time.Sleep(backoff)
+		backoff = min(2*backoff, deployBackoffMax)
+	}
+}
+
+func (server *HSyncServer) execDeployCmdOnce(job *deployJob, newCmd func(ctx context.Context) *exec.Cmd) *deployResult {
+	ctx := context.Background()
+	if server.conf.DeployTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(server.conf.DeployTimeout)*time.Second)
+		defer cancel()
+	}
+	cmd := newCmd(ctx)
+	setCmdKill(cmd)
+	cmd.WaitDelay = time.Second
+	out := &limitWriter{max: deployOutputMax}
+	cmd.Stdout = out
+	cmd.Stderr = out
+
+	start := time.Now()
+	err := cmd.Run()
+	res := &deployResult{
+		Time:     start,
+		Event:    job.Event,
+		Dst:      job.Dst,
+		Src:      job.Src,
+		ExitCode: cmd.ProcessState.ExitCode(),
+		Duration: time.Since(start).Round(time.Millisecond).String(),
+		Output:   out.String(),
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("timeout after %ds, killed", server.conf.DeployTimeout)
+	}
+	if err != nil {
+		res.Err = err.Error()
+	}
+	glog.Infof("deployCmd %s [%s]->[%s],exit=%d,cost=%s,err=%v", job.Event, job.Src, job.Dst, res.ExitCode, res.Duration, err)
+	glog.V(2).Infoln("deployCmd", cmd.Args, "output:", res.Output)
+	return res
+}
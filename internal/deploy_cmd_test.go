@@ -0,0 +1,99 @@
+package internal
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHSyncServer_execDeployCmd(t *testing.T) {
+	home := t.TempDir()
+	server := &HSyncServer{
+		conf:   &ServerConf{Home: home, DeployTimeout: 1, DeployRetries: 1, DeployResults: 10},
+		runner: newDeployRunner(2),
+	}
+	server.trans = &Trans{stats: &transStats{success: map[string]int64{}, fail: map[string]int64{}, denied: map[string]int64{}, last: map[string]string{}}}
+	deploy := &ServerConfDeploy{From: "a", To: "d"}
+	run := func(cmd ...string) *deployResult {
+		deploy.DeployCmd = cmd
+		server.runDeployCmd(&deployJob{Deploy: deploy, Dst: "d/x", Src: "a/x", Event: deployUpdate})
+		server.runner.wait()
+		results := server.trans.stats.deploy[deploy.key()]
+		return results[len(results)-1]
+	}
+
+	res := run("sh", "-c", "echo {event}; echo oops >&2")
+	require.Empty(t, res.Err)
+	require.Equal(t, 0, res.ExitCode)
+	require.Equal(t, 1, res.Attempts)
+	require.Equal(t, "update\noops\n", res.Output)
+
+	// fails the first time only
+	flag := filepath.Join(home, "flag")
+	res = run("sh", "-c", fmt.Sprintf("test -e %s || { touch %s; exit 3; }", flag, flag))
+	require.Empty(t, res.Err)
+	require.Equal(t, 2, res.Attempts)
+
+	// the children of the script are killed too
+	start := time.Now()
+	res = run("sh", "-c", "sleep 10 & sleep 10")
+	require.Contains(t, res.Err, "timeout")
+	require.Equal(t, -1, res.ExitCode)
+	require.Less(t, time.Since(start), 8*time.Second)
+	require.Len(t, server.trans.stats.deploy[deploy.key()], 3)
+	require.Equal(t, int64(2), server.trans.stats.success["DeployCmd"])
+	require.Equal(t, int64(1), server.trans.stats.fail["DeployCmd"])
+}
+
+func TestDeployRunner(t *testing.T) {
+	r := newDeployRunner(3)
+	var got []int
+	for i := 0; i < 100; i++ {
+		r.submit("same", func() {
+			got = append(got, i)
+		})
+	}
+	r.wait()
+	require.Len(t, got, 100)
+	for i, v := range got {
+		require.Equal(t, i, v)
+	}
+
+	// submit and after do not wait for a busy worker
+	gate := make(chan struct{})
+	var done atomic.Int32
+	r.submit("busy", func() {
+		<-gate
+	})
+	for i := 0; i < 200; i++ {
+		r.submit("busy", func() {
+			done.Add(1)
+		})
+	}
+	var afterDone atomic.Int32
+	r.after(func() {
+		afterDone.Store(done.Load())
+	})
+	require.Equal(t, int32(0), done.Load())
+	close(gate)
+	r.wait()
+	require.Equal(t, int32(200), afterDone.Load())
+
+	w := &limitWriter{max: 5}
+	w.Write([]byte("abc"))
+	w.Write([]byte("defg"))
+	require.Equal(t, "abcde...(truncated)", w.String())
+
+	ts := &transStats{success: map[string]int64{}, fail: map[string]int64{}, denied: map[string]int64{}, last: map[string]string{}}
+	for i := 0; i < 5; i++ {
+		ts.addDeployResult("k", &deployResult{Dst: fmt.Sprint(i)}, 3)
+	}
+	require.Len(t, ts.deploy["k"], 3)
+	require.Equal(t, "2", ts.deploy["k"][0].Dst)
+	require.True(t, strings.Contains(ts.String(), `"Deploy"`))
+}
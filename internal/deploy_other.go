@@ -0,0 +1,10 @@
+//go:build !unix
+
+package internal
+
+import (
+	"os/exec"
+)
+
+// setCmdKill only the cmd itself is killed on timeout on this platform
+func setCmdKill(cmd *exec.Cmd) {}
@@ -0,0 +1,242 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// the layout of a release deploy under its To
+const (
+	releaseCurrent  = "current"
+	releasePrevious = "previous"
+	releasesDir     = "releases"
+
+	releaseTimeFormat = "20060102-150405.000"
+)
+
+// release one release of a deploy, Dir and Prev are absolute
+type release struct {
+	Name string
+	Dir  string
+
+	// Prev the dir of the current release, empty when there is none
+	Prev string
+}
+
+// releaseBase returns the absolute To of dc
+func (server *HSyncServer) releaseBase(dc *ServerConfDeploy) string {
+	return server.conf.homePath(dc.To)
+}
+
+// releaseLink returns the name of the release the link of dc points to,
+// empty when there is none
+func (server *HSyncServer) releaseLink(dc *ServerConfDeploy, link string) string {
+	target, err := os.Readlink(filepath.Join(server.releaseBase(dc), link))
+	if err != nil {
+		return ""
+	}
+	return filepath.Base(target)
+}
+
+// listReleases returns the names of the releases of dc from the oldest,
+// with the name of the current one
+func (server *HSyncServer) listReleases(dc *ServerConfDeploy) (names []string, current string) {
+	base := server.releaseBase(dc)
+	current = server.releaseLink(dc, releaseCurrent)
+	entries, err := os.ReadDir(filepath.Join(base, releasesDir))
+	if err != nil {
+		return nil, current
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && !isUploadTmp(entry.Name()) {
+			names = append(names, entry.Name())
+		}
+	}
+	slices.Sort(names)
+	return names, current
+}
+
+// newRelease creates the dir of the next release of dc, it is only named when dryRun
+func (server *HSyncServer) newRelease(dc *ServerConfDeploy, dryRun bool) (*release, error) {
+	base := server.releaseBase(dc)
+	rel := &release{}
+	if _, current := server.listReleases(dc); current != "" {
+		rel.Prev = filepath.Join(base, releasesDir, current)
+	}
+	if !dryRun {
+		if err := checkDir(filepath.Join(base, releasesDir), 0755); err != nil {
+			return nil, err
+		}
+	}
+	for t := time.Now(); ; t = t.Add(time.Millisecond) {
+		rel.Name = t.Format(releaseTimeFormat)
+		rel.Dir = filepath.Join(base, releasesDir, rel.Name)
+		if dryRun {
+			return rel, nil
+		}
+		err := os.Mkdir(rel.Dir, 0755)
+		if err == nil {
+			return rel, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+	}
+}
+
+// switchRelease points the current of dc to the release name atomically,
+// the release it pointed to is recorded as the previous one for Rollback
+func (server *HSyncServer) switchRelease(dc *ServerConfDeploy, name string) error {
+	if current := server.releaseLink(dc, releaseCurrent); current != "" && current != name {
+		if err := server.setReleaseLink(dc, releasePrevious, current); err != nil {
+			return err
+		}
+	}
+	if err := server.setReleaseLink(dc, releaseCurrent, name); err != nil {
+		return err
+	}
+	glog.Infof("deploy [%s] switched to release %s", dc.key(), name)
+	return nil
+}
+
+// setReleaseLink points the link of dc to the release name atomically
+func (server *HSyncServer) setReleaseLink(dc *ServerConfDeploy, link string, name string) error {
+	base := server.releaseBase(dc)
+	tmp := filepath.Join(base, uploadTmpPrefix+link)
+	os.Remove(tmp)
+	if err := os.Symlink(filepath.Join(releasesDir, name), tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(base, link)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// pruneReleases removes the releases of dc older than the last KeepReleases,
+// the current and the previous ones are always kept
+func (server *HSyncServer) pruneReleases(dc *ServerConfDeploy) {
+	names, current := server.listReleases(dc)
+	previous := server.releaseLink(dc, releasePrevious)
+	for _, name := range names[:max(len(names)-dc.KeepReleases, 0)] {
+		if name == current || name == previous {
+			continue
+		}
+		err := os.RemoveAll(filepath.Join(server.releaseBase(dc), releasesDir, name))
+		glog.Infof("deploy [%s] remove release %s, err=%v", dc.key(), name, err)
+	}
+}
+
+// releaseState the releases of one deploy built by the events
+type releaseState struct {
+	// last the time the last release was built
+	last time.Time
+
+	// pending the changes not released yet
+	pending bool
+}
+
+// deployReleases builds a new release of each release deploy the events change,
+// at most once in its ReleaseInterval, the changes delayed by it are released
+// by a later call. The jobs of the files changed are returned.
+func (server *HSyncServer) deployReleases(events map[string]*deployEvent) (done []*deployJob) {
+	now := time.Now()
+	for _, dc := range server.conf.Deploy {
+		if !dc.Release {
+			continue
+		}
+		if server.releases == nil {
+			server.releases = make(map[*ServerConfDeploy]*releaseState)
+		}
+		state := server.releases[dc]
+		if state == nil {
+			state = &releaseState{}
+			server.releases[dc] = state
+		}
+		if releaseChanged(dc, events) {
+			state.pending = true
+		}
+		if !state.pending || now.Sub(state.last) < time.Duration(dc.ReleaseInterval)*time.Second {
+			continue
+		}
+		state.pending = false
+		state.last = now
+		jobs, job := server.deployFull(dc, ".", &DeploySummary{}, &DeployOptions{})
+		if job == nil {
+			continue
+		}
+		server.runDeployCmd(job)
+		done = append(done, jobs...)
+	}
+	return done
+}
+
+// releaseChanged reports whether any of the events is under dc's from
+func releaseChanged(dc *ServerConfDeploy, events map[string]*deployEvent) bool {
+	for name, ev := range events {
+		if _, ok := dc.target(name); ok {
+			return true
+		}
+		if _, ok := dc.target(ev.From); ok && ev.From != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Rollback switches the current of the release deploy whose to or from is name
+// back to the previous release it pointed to, then runs its deployCmd with the
+// rollback event. The previous release is forgotten, so it can not be repeated.
+func (server *HSyncServer) Rollback(name string, opts DeployOptions) error {
+	var dc *ServerConfDeploy
+	for _, deploy := range server.conf.Deploy {
+		if deploy.Release && (filepath.Clean(name) == filepath.Clean(deploy.To) || filepath.Clean(name) == filepath.Clean(deploy.From)) {
+			dc = deploy
+			break
+		}
+	}
+	if dc == nil {
+		return fmt.Errorf("no release deploy %q", name)
+	}
+	current := server.releaseLink(dc, releaseCurrent)
+	prev := server.releaseLink(dc, releasePrevious)
+	if prev == "" || prev == current {
+		return fmt.Errorf("deploy [%s] has no previous release of %q", dc.key(), current)
+	}
+	if info, err := os.Stat(filepath.Join(server.releaseBase(dc), releasesDir, prev)); err != nil || !info.IsDir() {
+		return fmt.Errorf("deploy [%s] previous release %q not found", dc.key(), prev)
+	}
+	opts.printf("rollback %s: %s -> %s\n", dc.current(), current, prev)
+	if opts.DryRun {
+		return nil
+	}
+	if err := server.setReleaseLink(dc, releaseCurrent, prev); err != nil {
+		return err
+	}
+	os.Remove(filepath.Join(server.releaseBase(dc), releasePrevious))
+	glog.Infof("deploy [%s] rolled back to release %s", dc.key(), prev)
+
+	var errCmd error
+	job := &deployJob{
+		Deploy:  dc,
+		Dst:     dc.current(),
+		Src:     dc.From,
+		Event:   deployRollback,
+		Release: filepath.Join(dc.To, releasesDir, prev),
+		onResult: func(res *deployResult) {
+			if res.Err != "" {
+				errCmd = errors.New("deployCmd failed: " + res.Err)
+			}
+		},
+	}
+	server.runDeployCmd(job)
+	server.runner.wait()
+	return errCmd
+}
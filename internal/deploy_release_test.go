@@ -0,0 +1,114 @@
+package internal
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHSyncServer_deployRelease(t *testing.T) {
+	home := testHome(t)
+	current := func() string {
+		target, err := os.Readlink(filepath.Join(home, "www", releaseCurrent))
+		require.NoError(t, err)
+		return filepath.Base(target)
+	}
+	writeTestFile(t, home, "src/a.txt", "a")
+	writeTestFile(t, home, "src/sub/b.txt", "b")
+	dc := &ServerConfDeploy{
+		From:         "src",
+		To:           "www",
+		Release:      true,
+		KeepReleases: 2,
+		DeployCmd:    CmdArgs{"sh", "-c", `echo "$HSYNC_EVENT $HSYNC_RELEASE" >> "$HSYNC_HOME/cmd.log"`},
+	}
+	require.NoError(t, dc.parse())
+	require.Error(t, (&ServerConfDeploy{Release: true, KeepDeletes: true}).parse())
+	server := &HSyncServer{conf: &ServerConf{
+		Home:          home,
+		StateDir:      filepath.Join(home, ".hsyncd"),
+		DeployWorkers: 2,
+		DeployResults: 10,
+		Deploy:        []*ServerConfDeploy{dc},
+	}}
+	dst, ok := server.conf.deployTarget(dc, "src/a.txt")
+	require.True(t, ok)
+	require.Equal(t, "www/current/a.txt", dst)
+
+	summary := server.DeployAll(DeployOptions{DryRun: true})
+	require.Equal(t, "copied=2, skipped=0, deleted=0, failed=0", summary.String())
+	require.NoDirExists(t, filepath.Join(home, "www"))
+
+	summary = server.DeployAll(DeployOptions{})
+	require.Equal(t, "copied=2, skipped=0, deleted=0, failed=0", summary.String())
+	first := current()
+	require.Equal(t, "a", readTestFile(home, "www/current/a.txt"))
+	require.Equal(t, "update www/releases/"+first+"\n", readTestFile(home, "cmd.log"))
+
+	// the unchanged file is linked from the previous release, which is kept as it was
+	writeTestFile(t, home, "src/a.txt", "A")
+	require.NoError(t, os.Remove(filepath.Join(home, "src", "sub", "b.txt")))
+	writeTestFile(t, home, "src/c.txt", "c")
+	var out bytes.Buffer
+	summary = server.DeployAll(DeployOptions{DryRun: true, Out: &out, Only: []string{"src/sub"}})
+	require.Equal(t, "copied=2, skipped=0, deleted=1, failed=0", summary.String())
+	require.Contains(t, out.String(), "delete  www/current/sub/b.txt\n")
+	require.Equal(t, first, current())
+
+	writeTestFile(t, home, "src/d.txt", "d")
+	done := server.deployReleases(map[string]*deployEvent{"src/d.txt": {Type: EventUpdate}})
+	require.Len(t, done, 4)
+	second := current()
+	require.NotEqual(t, first, second)
+	require.Equal(t, "A", readTestFile(home, "www/current/a.txt"))
+	require.Empty(t, readTestFile(home, "www/current/sub/b.txt"))
+	require.Equal(t, "a", readTestFile(home, "www/releases/"+first+"/a.txt"))
+	require.Equal(t, "b", readTestFile(home, "www/releases/"+first+"/sub/b.txt"))
+	require.Empty(t, server.deployReleases(map[string]*deployEvent{"other/e.txt": {Type: EventUpdate}}))
+
+	summary = server.DeployAll(DeployOptions{})
+	require.Equal(t, "copied=0, skipped=3, deleted=0, failed=0", summary.String())
+	third := current()
+	info2, err := os.Stat(filepath.Join(home, "www", "releases", second, "c.txt"))
+	require.NoError(t, err)
+	info3, err := os.Stat(filepath.Join(home, "www", "releases", third, "c.txt"))
+	require.NoError(t, err)
+	require.True(t, os.SameFile(info2, info3))
+
+	// only the last KeepReleases are kept
+	names, _ := server.listReleases(dc)
+	require.Equal(t, []string{second, third}, names)
+
+	out.Reset()
+	require.NoError(t, server.Rollback("www", DeployOptions{DryRun: true, Out: &out}))
+	require.Equal(t, "rollback www/current: "+third+" -> "+second+"\n", out.String())
+	require.Equal(t, third, current())
+
+	require.NoError(t, server.Rollback("src", DeployOptions{}))
+	require.Equal(t, second, current())
+	require.Contains(t, readTestFile(home, "cmd.log"), "rollback www/releases/"+second+"\n")
+	require.Error(t, server.Rollback("www", DeployOptions{}))
+	require.Error(t, server.Rollback("other", DeployOptions{}))
+
+	// the changes in releaseInterval are released together after it
+	dc.ReleaseInterval = 3600
+	writeTestFile(t, home, "src/e.txt", "e")
+	require.Empty(t, server.deployReleases(map[string]*deployEvent{"src/e.txt": {Type: EventUpdate}}))
+	require.Empty(t, server.deployReleases(nil))
+	require.Equal(t, second, current())
+	server.releases[dc].last = time.Now().Add(-2 * time.Hour)
+	require.Len(t, server.deployReleases(nil), 1)
+	require.NotEqual(t, second, current())
+	require.Equal(t, "e", readTestFile(home, "www/current/e.txt"))
+	require.Empty(t, server.deployReleases(nil))
+
+	// the release rolled back to is the previous one, not the newest before it
+	require.Equal(t, second, server.releaseLink(dc, releasePrevious))
+	require.DirExists(t, filepath.Join(home, "www", "releases", second))
+	require.NoError(t, server.Rollback("www", DeployOptions{}))
+	require.Equal(t, second, current())
+}
@@ -0,0 +1,205 @@
+package internal
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testHome returns a temp server home, deploys run in it,
+// so the cwd is restored after the test
+func testHome(t *testing.T) string {
+	pwd, err := os.Getwd()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		os.Chdir(pwd)
+	})
+	return t.TempDir()
+}
+
+// writeTestFile writes name under home with its parent dirs
+func writeTestFile(t *testing.T, home string, name string, content string) {
+	require.NoError(t, checkDir(filepath.Dir(filepath.Join(home, name)), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(home, name), []byte(content), 0644))
+}
+
+// readTestFile returns the content of name under home, empty when it is missing
+func readTestFile(home string, name string) string {
+	data, err := os.ReadFile(filepath.Join(home, name))
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+func TestTrans_addRenameEvent(t *testing.T) {
+	trans := newTestTrans(t.TempDir())
+	user := &ServerConfUser{Name: "tom"}
+
+	trans.addRenameEvent(user, "b.txt", "a.txt")
+	trans.addEvent(user, "b.txt", EventUpdate)
+	require.Equal(t, &deployEvent{Type: EventRename, From: "a.txt", User: "tom", seq: 1}, trans.events["b.txt"])
+
+	trans.addRenameEvent(user, "c.txt", "b.txt")
+	require.Nil(t, trans.events["b.txt"])
+	require.Equal(t, "a.txt", trans.events["c.txt"].From)
+
+	trans.addEvent(user, "c.txt", EventDelete)
+	require.Equal(t, EventType(EventDelete), trans.events["c.txt"].Type)
+	require.Equal(t, "a.txt", trans.events["c.txt"].From)
+
+	trans.addEvent(user, filepath.Join("d", "e.txt"), EventUpdate)
+	trans.addRenameEvent(user, "f", "d")
+	ev := trans.events[filepath.Join("f", "e.txt")]
+	require.Equal(t, EventType(EventUpdate), ev.Type)
+	require.Greater(t, ev.seq, trans.events["f"].seq)
+}
+
+func TestHSyncServer_dealEvent(t *testing.T) {
+	home := testHome(t)
+	server := &HSyncServer{conf: &ServerConf{
+		Home: home,
+		Deploy: []*ServerConfDeploy{
+			{From: "src", To: "out1"},
+			{From: "src", To: "out2", KeepDeletes: true},
+		},
+	}}
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(home, name))
+		return err == nil
+	}
+
+	writeTestFile(t, home, "src/a.txt", "a")
+	writeTestFile(t, home, "src/b.txt", "b")
+	server.dealEvent("src/a.txt", &deployEvent{Type: EventUpdate})
+	server.dealEvent("src/b.txt", &deployEvent{Type: EventUpdate})
+	require.True(t, exists("out1/a.txt"))
+	require.True(t, exists("out2/b.txt"))
+
+	require.NoError(t, os.Rename(filepath.Join(home, "src/a.txt"), filepath.Join(home, "src/c.txt")))
+	server.dealEvent("src/c.txt", &deployEvent{Type: EventRename, From: "src/a.txt"})
+	require.False(t, exists("out1/a.txt"))
+	require.True(t, exists("out1/c.txt"))
+	require.True(t, exists("out2/a.txt"))
+	require.True(t, exists("out2/c.txt"))
+
+	require.NoError(t, os.Remove(filepath.Join(home, "src/b.txt")))
+	server.dealEvent("src/b.txt", &deployEvent{Type: EventDelete})
+	require.False(t, exists("out1/b.txt"))
+	require.True(t, exists("out2/b.txt"))
+
+	// moved out of the deploy from dir
+	require.NoError(t, os.Rename(filepath.Join(home, "src/c.txt"), filepath.Join(home, "c.txt")))
+	server.dealEvent("c.txt", &deployEvent{Type: EventRename, From: "src/c.txt"})
+	require.False(t, exists("out1/c.txt"))
+	require.True(t, exists("out2/c.txt"))
+}
+
+func TestHSyncServer_deployFilterCmd(t *testing.T) {
+	home := testHome(t)
+	js := &ServerConfDeploy{
+		From:      "js",
+		To:        "cdn",
+		Ignore:    []string{"*.map"},
+		DeployCmd: CmdArgs{"sh", "-c", `echo "$0:$1:$2:$HSYNC_T">>log`},
+		Dir:       "cmd",
+		Env:       map[string]string{"HSYNC_T": "js"},
+	}
+	php := &ServerConfDeploy{From: "php", To: "app", Allow: []string{"*.php"}}
+	server := &HSyncServer{conf: &ServerConf{Home: home, Deploy: []*ServerConfDeploy{js, php}}}
+	require.NoError(t, js.parse())
+	require.NoError(t, php.parse())
+	for _, name := range []string{"js/a.js", "js/a.js.map", "js/sub/b.js.map", "php/lib/c.php", "php/lib/c.txt", "cmd/.keep"} {
+		writeTestFile(t, home, name, name)
+	}
+
+	require.Equal(t, []string{"cdn/a.js"}, server.conf.getDeployTo("js/a.js"))
+	require.Empty(t, server.conf.getDeployTo("js/a.js.map"))
+	require.Equal(t, []string{"app/lib"}, server.conf.getDeployTo("php/lib"))
+	require.Empty(t, server.conf.getDeployTo("php/lib/c.txt"))
+
+	server.dealEvent("js", &deployEvent{Type: EventUpdate})
+	server.dealEvent("php/lib", &deployEvent{Type: EventUpdate})
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(home, name))
+		return err == nil
+	}
+	require.True(t, exists("cdn/a.js"))
+	require.False(t, exists("cdn/a.js.map"))
+	require.False(t, exists("cdn/sub/b.js.map"))
+	require.True(t, exists("app/lib/c.php"))
+	require.False(t, exists("app/lib/c.txt"))
+
+	require.Equal(t, "cdn:js:update:js\n", readTestFile(home, "cmd/log"))
+}
+
+func TestHSyncServer_runDeployCmd(t *testing.T) {
+	home := t.TempDir()
+	server := &HSyncServer{conf: &ServerConf{Home: home, ConfDir: "/etc/hsync"}}
+	var cmd CmdArgs
+	require.NoError(t, json.Unmarshal([]byte(`"sh -c 'echo \"$1 {event} $HSYNC_CLIENT $HSYNC_DEPLOY_TO\" > \"$0\"' 'out file' {dst}"`), &cmd))
+	require.Equal(t, CmdArgs{"sh", "-c", `echo "$1 {event} $HSYNC_CLIENT $HSYNC_DEPLOY_TO" > "$0"`, "out file", "{dst}"}, cmd)
+	job := &deployJob{
+		Deploy: &ServerConfDeploy{From: "a", To: "d", DeployCmd: cmd},
+		Dst:    "d/x y.txt",
+		Src:    "a/x y.txt",
+		Event:  deployUpdate,
+		Client: "tom",
+	}
+	server.runDeployCmd(job)
+	got, err := os.ReadFile(filepath.Join(home, "out file"))
+	require.NoError(t, err)
+	require.Equal(t, "d/x y.txt update tom d\n", string(got))
+
+	// without named placeholders the positional args are appended
+	args, named := expandDeployCmd([]string{"bash", "{pwd}/deploy.sh"}, server.deployCmdVars(job))
+	require.False(t, named)
+	require.Equal(t, []string{"bash", "/etc/hsync/deploy.sh"}, args)
+}
+
+func TestTrans_eventsReady(t *testing.T) {
+	trans := newTestTrans(t.TempDir())
+	user := &ServerConfUser{Name: "tom"}
+	settle, maxWait := time.Second, 5*time.Second
+	require.False(t, trans.eventsReady(time.Now(), settle, maxWait, true))
+
+	trans.addEvent(user, "a.txt", EventUpdate)
+	start := trans.firstEvent
+	require.False(t, trans.eventsReady(start.Add(settle/2), settle, maxWait, false))
+	require.True(t, trans.eventsReady(start.Add(settle/2), settle, maxWait, true))
+	require.True(t, trans.eventsReady(start.Add(settle), settle, maxWait, false))
+
+	// chunks received keep the window open until the max wait
+	trans.lastActive = start.Add(4500 * time.Millisecond)
+	require.False(t, trans.eventsReady(start.Add(4900*time.Millisecond), settle, maxWait, false))
+	require.True(t, trans.eventsReady(start.Add(maxWait), settle, maxWait, false))
+
+	trans.copyEvents()
+	require.True(t, trans.firstEvent.IsZero())
+	trans.flushEvents()
+	trans.flushEvents()
+	require.Len(t, trans.flush, 1)
+}
+
+func TestServerConfDeploy_targetSibling(t *testing.T) {
+	home := testHome(t)
+	deploy := &ServerConfDeploy{From: "a", To: "www/d"}
+	require.NoError(t, deploy.parse())
+	dst, ok := deploy.target("a/x.txt")
+	require.True(t, ok)
+	require.Equal(t, filepath.Join("www", "d", "x.txt"), dst)
+	_, ok = deploy.target("ab/x.txt")
+	require.False(t, ok)
+	_, ok = deploy.target("a")
+	require.True(t, ok)
+
+	// deleting a sibling which shares the prefix of from keeps the files beside the target
+	writeTestFile(t, home, "www/ab/x.txt", "x")
+	server := &HSyncServer{conf: &ServerConf{Home: home, Deploy: []*ServerConfDeploy{deploy}}}
+	require.Empty(t, server.dealEvent("ab/x.txt", &deployEvent{Type: EventDelete}))
+	require.FileExists(t, filepath.Join(home, "www", "ab", "x.txt"))
+}
@@ -0,0 +1,17 @@
+//go:build unix
+
+package internal
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setCmdKill runs cmd in its own process group, so the children
+// of a script are killed with it on timeout
+func setCmdKill(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
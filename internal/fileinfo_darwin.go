@@ -0,0 +1,15 @@
+package internal
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileSysStat returns the inode and the ctime in unix nano of info
+func fileSysStat(info os.FileInfo) (ino uint64, ctime int64) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0
+	}
+	return uint64(st.Ino), st.Ctimespec.Nano()
+}
@@ -0,0 +1,12 @@
+//go:build !linux && !darwin
+
+package internal
+
+import (
+	"os"
+)
+
+// fileSysStat inode and ctime are not used on this platform
+func fileSysStat(info os.FileInfo) (ino uint64, ctime int64) {
+	return 0, 0
+}
@@ -0,0 +1,241 @@
+package internal
+
+import (
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	hashIndexFileName = "hashindex.gob"
+	hashIndexVersion  = 1
+
+	// files changed within it may be changed again in the same mtime tick,
+	// their hash is not cached
+	hashIndexRacyWindow = 2 * time.Second
+)
+
+type hashIndexEntry struct {
+	Ino   uint64
+	Size  int64
+	Mtime int64
+	Ctime int64
+	Md5   string
+}
+
+type hashIndexFile struct {
+	Version int
+	Entries map[string]*hashIndexEntry
+}
+
+// hashIndex caches the md5 of files keyed by path, the md5 is only
+// computed again when inode, size, mtime or ctime changed.
+// A nil *hashIndex always computes the md5.
+type hashIndex struct {
+	path    string
+	entries map[string]*hashIndexEntry
+	dirty   bool
+	mu      sync.RWMutex
+
+	// byMd5 the names of entries by md5, for lookup
+	byMd5 map[string]map[string]struct{}
+
+	// followLinks stats the target of symlinks instead of the links
+	followLinks bool
+}
+
+// openHashIndex loads the index saved at path, a corrupt index is rebuilt
+func openHashIndex(path string) *hashIndex {
+	hi := &hashIndex{
+		path:    path,
+		entries: make(map[string]*hashIndexEntry),
+		byMd5:   make(map[string]map[string]struct{}),
+	}
+	err := hi.load()
+	if err != nil && !os.IsNotExist(err) {
+		glog.Warningln("load hash index", path, "failed, rebuild it:", err)
+	}
+	glog.Infoln("hash index", path, "loaded", len(hi.entries), "entries")
+	return hi
+}
+
+func (hi *hashIndex) stat(name string) (os.FileInfo, error) {
+	if hi != nil && hi.followLinks {
+		return os.Stat(name)
+	}
+	return os.Lstat(name)
+}
+
+func (hi *hashIndex) load() error {
+	f, err := os.Open(hi.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var data hashIndexFile
+	if err = gob.NewDecoder(f).Decode(&data); err != nil {
+		return err
+	}
+	if data.Version != hashIndexVersion {
+		return fmt.Errorf("version %d not supported", data.Version)
+	}
+	if data.Entries != nil {
+		hi.entries = data.Entries
+	}
+	for name, e := range hi.entries {
+		hi.addMd5(name, e.Md5)
+	}
+	return nil
+}
+
+func newHashIndexEntry(info os.FileInfo) *hashIndexEntry {
+	ino, ctime := fileSysStat(info)
+	return &hashIndexEntry{
+		Ino:   ino,
+		Size:  info.Size(),
+		Mtime: info.ModTime().UnixNano(),
+		Ctime: ctime,
+	}
+}
+
+func (e *hashIndexEntry) sameMeta(o *hashIndexEntry) bool {
+	return e.Ino == o.Ino && e.Size == o.Size && e.Mtime == o.Mtime && e.Ctime == o.Ctime
+}
+
+// fileMd5 returns the md5 of name whose stat is info
+func (hi *hashIndex) fileMd5(name string, info os.FileInfo) string {
+	if hi == nil {
+		return FileMd5(name)
+	}
+	cur := newHashIndexEntry(info)
+	hi.mu.RLock()
+	old := hi.entries[name]
+	hi.mu.RUnlock()
+	if old != nil && old.sameMeta(cur) {
+		return old.Md5
+	}
+	cur.Md5 = FileMd5(name)
+	hi.put(name, info, cur)
+	return cur.Md5
+}
+
+// lookup returns the files whose cached md5 is md5 and not changed since
+func (hi *hashIndex) lookup(md5 string) []string {
+	if hi == nil {
+		return nil
+	}
+	hi.mu.RLock()
+	names := make([]string, 0, len(hi.byMd5[md5]))
+	for name := range hi.byMd5[md5] {
+		names = append(names, name)
+	}
+	hi.mu.RUnlock()
+	valid := names[:0]
+	for _, name := range names {
+		info, err := os.Stat(name)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		hi.mu.RLock()
+		e := hi.entries[name]
+		hi.mu.RUnlock()
+		if e != nil && e.Md5 == md5 && e.sameMeta(newHashIndexEntry(info)) {
+			valid = append(valid, name)
+		}
+	}
+	return valid
+}
+
+func (hi *hashIndex) put(name string, info os.FileInfo, e *hashIndexEntry) {
+	if e.Md5 == "" || time.Since(info.ModTime()) < hashIndexRacyWindow {
+		return
+	}
+	hi.mu.Lock()
+	defer hi.mu.Unlock()
+	if old := hi.entries[name]; old != nil {
+		hi.removeMd5(name, old.Md5)
+	}
+	hi.entries[name] = e
+	hi.addMd5(name, e.Md5)
+	hi.dirty = true
+}
+
+func (hi *hashIndex) remove(name string) {
+	if hi == nil {
+		return
+	}
+	hi.mu.Lock()
+	defer hi.mu.Unlock()
+	if e, has := hi.entries[name]; has {
+		hi.removeMd5(name, e.Md5)
+		delete(hi.entries, name)
+		hi.dirty = true
+	}
+}
+
+// addMd5 and removeMd5 keep byMd5 in step with entries, hi.mu must be held
+func (hi *hashIndex) addMd5(name string, md5 string) {
+	names := hi.byMd5[md5]
+	if names == nil {
+		names = make(map[string]struct{})
+		hi.byMd5[md5] = names
+	}
+	names[name] = struct{}{}
+}
+
+func (hi *hashIndex) removeMd5(name string, md5 string) {
+	names := hi.byMd5[md5]
+	delete(names, name)
+	if len(names) == 0 {
+		delete(hi.byMd5, md5)
+	}
+}
+
+func (hi *hashIndex) save() error {
+	hi.mu.Lock()
+	if !hi.dirty {
+		hi.mu.Unlock()
+		return nil
+	}
+	hi.dirty = false
+	// encode a copy, so lookups are not blocked by the disk io
+	entries := make(map[string]*hashIndexEntry, len(hi.entries))
+	for k, v := range hi.entries {
+		entries[k] = v
+	}
+	hi.mu.Unlock()
+
+	if err := checkDir(filepath.Dir(hi.path), 0700); err != nil {
+		return err
+	}
+	tmp := hi.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(f).Encode(&hashIndexFile{Version: hashIndexVersion, Entries: entries})
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, hi.path)
+}
+
+// saveLoop saves the index to disk when it changed
+func (hi *hashIndex) saveLoop() {
+	tk := time.NewTicker(10 * time.Second)
+	defer tk.Stop()
+	for range tk.C {
+		if err := hi.save(); err != nil {
+			glog.Warningln("save hash index failed:", err)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHashIndex(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "a.txt")
+	require.NoError(t, os.WriteFile(name, []byte("hello"), 0644))
+	old := time.Now().Add(-time.Minute)
+	require.NoError(t, os.Chtimes(name, old, old))
+
+	indexPath := filepath.Join(dir, "state", hashIndexFileName)
+	hi := openHashIndex(indexPath)
+	info, err := os.Stat(name)
+	require.NoError(t, err)
+	require.Equal(t, StrMd5("hello"), hi.fileMd5(name, info))
+	require.NoError(t, hi.save())
+
+	// a cached md5 is used while the stat is not changed
+	hi = openHashIndex(indexPath)
+	require.Len(t, hi.entries, 1)
+	hi.entries[name].Md5 = "cached"
+	require.Equal(t, "cached", hi.fileMd5(name, info))
+
+	require.NoError(t, os.WriteFile(name, []byte("world"), 0644))
+	require.NoError(t, os.Chtimes(name, old, old))
+	info, err = os.Stat(name)
+	require.NoError(t, err)
+	require.Equal(t, StrMd5("world"), hi.fileMd5(name, info))
+
+	// a file just changed is not cached
+	require.NoError(t, os.WriteFile(name, []byte("new"), 0644))
+	info, err = os.Stat(name)
+	require.NoError(t, err)
+	hi.remove(name)
+	require.Equal(t, StrMd5("new"), hi.fileMd5(name, info))
+	require.Empty(t, hi.entries)
+}
+
+func TestHashIndex_corrupt(t *testing.T) {
+	indexPath := filepath.Join(t.TempDir(), hashIndexFileName)
+	require.NoError(t, os.WriteFile(indexPath, []byte("not a gob"), 0600))
+	hi := openHashIndex(indexPath)
+	require.Empty(t, hi.entries)
+
+	var nilIndex *hashIndex
+	nilIndex.remove("x")
+}
+
+func TestHashIndex_lookup(t *testing.T) {
+	dir := t.TempDir()
+	hi := openHashIndex(filepath.Join(dir, hashIndexFileName))
+	old := time.Now().Add(-time.Minute)
+	write := func(name string, content string) {
+		require.NoError(t, os.WriteFile(name, []byte(content), 0644))
+		require.NoError(t, os.Chtimes(name, old, old))
+		info, err := os.Stat(name)
+		require.NoError(t, err)
+		hi.fileMd5(name, info)
+	}
+	a, b := filepath.Join(dir, "a.txt"), filepath.Join(dir, "b.txt")
+	write(a, "hello")
+	write(b, "hello")
+	require.ElementsMatch(t, []string{a, b}, hi.lookup(StrMd5("hello")))
+
+	write(b, "world")
+	require.Equal(t, []string{a}, hi.lookup(StrMd5("hello")))
+	require.Equal(t, []string{b}, hi.lookup(StrMd5("world")))
+
+	hi.remove(a)
+	require.Empty(t, hi.lookup(StrMd5("hello")))
+	require.Len(t, hi.byMd5, 1)
+
+	// the names by md5 are rebuilt on load
+	require.NoError(t, hi.save())
+	hi = openHashIndex(filepath.Join(dir, hashIndexFileName))
+	require.Equal(t, []string{b}, hi.lookup(StrMd5("world")))
+}
@@ -0,0 +1,145 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// the symlink policies of ClientConf.Symlink
+const (
+	// symlinkPreserve recreates the link on the server
+	symlinkPreserve = "preserve"
+
+	// symlinkFollow sends the file or dir the link points to
+	symlinkFollow = "follow"
+
+	// symlinkSkip does not sync links
+	symlinkSkip = "skip"
+)
+
+func (stat *FileStat) IsLink() bool {
+	return stat.FileMode&os.ModeSymlink != 0
+}
+
+// syncWalk walks root like filepath.Walk, links are handled by policy:
+// skipped, passed to fn as links, or walked as the file or dir they point to.
+// A followed dir link pointing to one of the dirs being walked is a loop and skipped.
+func syncWalk(root string, policy string, fn filepath.WalkFunc) error {
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return fn(root, nil, err)
+	}
+	return syncWalkDir(root, realRoot, policy, []string{realRoot}, fn)
+}
+
+// syncWalkDir walks the real dir realDir, reporting the names under dir to fn,
+// chain is the real dirs of the followed links leading to it
+func syncWalkDir(dir string, realDir string, policy string, chain []string, fn filepath.WalkFunc) error {
+	return filepath.Walk(realDir, func(path string, info os.FileInfo, err error) error {
+		name := dir
+		if path != realDir {
+			name = filepath.Join(dir, strings.TrimPrefix(path, realDir+string(filepath.Separator)))
+		}
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			return fn(name, info, err)
+		}
+		switch policy {
+		case symlinkSkip:
+			glog.V(2).Infoln("skip symlink", name)
+			return nil
+		case symlinkFollow:
+		default:
+			return fn(name, info, nil)
+		}
+
+		target, err := os.Stat(path)
+		if err != nil {
+			glog.Warningln("follow symlink", name, "failed, skipped:", err)
+			return nil
+		}
+		if !target.IsDir() {
+			return fn(name, target, nil)
+		}
+		realTarget, err := filepath.EvalSymlinks(path)
+		if err != nil {
+			return fn(name, target, err)
+		}
+		for _, c := range chain {
+			if isSubPath(realTarget, c) {
+				glog.Warningf("symlink loop: %s -> %s, skipped", name, realTarget)
+				return nil
+			}
+		}
+		if err = fn(name, target, nil); err != nil {
+			if err == filepath.SkipDir {
+				return nil
+			}
+			return err
+		}
+		return syncWalkDir(name, realTarget, policy, append(chain[:len(chain):len(chain)], realTarget), func(p string, i os.FileInfo, err error) error {
+			if p == name {
+				// reported above
+				return nil
+			}
+			return fn(p, i, err)
+		})
+	})
+}
+
+// checkLinkTarget rejects the target of the link fullName when it is absolute
+// or resolves outside the root of user
+func (trans *Trans) checkLinkTarget(user *ServerConfUser, fullName string, target string) error {
+	if target == "" {
+		return &PathDeniedError{Name: fullName, Reason: "empty symlink target"}
+	}
+	if filepath.IsAbs(target) || filepath.VolumeName(target) != "" {
+		return &PathDeniedError{Name: target, Reason: "absolute symlink target"}
+	}
+	realRoot, err := filepath.EvalSymlinks(filepath.Join(trans.server.conf.Home, user.Root))
+	if err != nil {
+		return err
+	}
+	resolved, err := resolveLinkTarget(filepath.Dir(fullName), target)
+	if err != nil {
+		return err
+	}
+	if !isSubPath(realRoot, resolved) {
+		return &PathDeniedError{Name: target, Reason: "symlink target escapes home"}
+	}
+	return nil
+}
+
+// makeSymlink replaces fullName with a link to target
+func (trans *Trans) makeSymlink(user *ServerConfUser, fullName string, target string) error {
+	target = filepath.FromSlash(target)
+	if err := trans.checkLinkTarget(user, fullName, target); err != nil {
+		return err
+	}
+	if old, err := os.Readlink(fullName); err == nil && old == target {
+		return nil
+	}
+	if err := checkDir(filepath.Dir(fullName), 0755); err != nil {
+		return err
+	}
+	tmpName := filepath.Join(filepath.Dir(fullName), fmt.Sprintf("%s%s-link", uploadTmpPrefix, filepath.Base(fullName)))
+	os.Remove(tmpName)
+	if err := os.Symlink(target, tmpName); err != nil {
+		return err
+	}
+	if info, err := os.Lstat(fullName); err == nil && info.IsDir() {
+		glog.Infof("symlink [%s] exists and is dir, removeAll", fullName)
+		if err = os.RemoveAll(fullName); err != nil {
+			os.Remove(tmpName)
+			return err
+		}
+	}
+	if err := os.Rename(tmpName, fullName); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyncWalk(t *testing.T) {
+	base := t.TempDir()
+	home := filepath.Join(base, "home")
+	require.NoError(t, os.MkdirAll(filepath.Join(home, "a"), 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(base, "lib"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(home, "a", "x.txt"), []byte("x"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(base, "lib", "y.txt"), []byte("y"), 0644))
+	require.NoError(t, os.Symlink("../lib", filepath.Join(home, "lib")))
+	require.NoError(t, os.Symlink("x.txt", filepath.Join(home, "a", "x.link")))
+	// loops back to home
+	require.NoError(t, os.Symlink("..", filepath.Join(home, "a", "up")))
+	require.NoError(t, os.Symlink(home, filepath.Join(base, "lib", "home")))
+
+	walk := func(policy string) []string {
+		var names []string
+		err := syncWalk(home, policy, func(path string, info os.FileInfo, err error) error {
+			require.NoError(t, err)
+			rel, _ := filepath.Rel(home, path)
+			if info.Mode()&os.ModeSymlink != 0 {
+				rel += "@"
+			}
+			names = append(names, filepath.ToSlash(rel))
+			return nil
+		})
+		require.NoError(t, err)
+		sort.Strings(names)
+		return names
+	}
+	require.Equal(t, []string{".", "a", "a/up@", "a/x.link@", "a/x.txt", "lib@"}, walk(symlinkPreserve))
+	require.Equal(t, []string{".", "a", "a/x.txt"}, walk(symlinkSkip))
+	require.Equal(t, []string{".", "a", "a/x.link", "a/x.txt", "lib", "lib/y.txt"}, walk(symlinkFollow))
+}
+
+func TestTrans_makeSymlink(t *testing.T) {
+	home := t.TempDir()
+	trans := newTestTrans(home)
+	user := &ServerConfUser{Name: "tom", Root: "tom"}
+	require.NoError(t, os.MkdirAll(filepath.Join(home, "tom", "sub"), 0755))
+
+	name := filepath.Join(home, "tom", "sub", "l")
+	require.NoError(t, trans.makeSymlink(user, name, "../a.txt"))
+	require.NoError(t, trans.makeSymlink(user, name, "b.txt"))
+	target, err := os.Readlink(name)
+	require.NoError(t, err)
+	require.Equal(t, "b.txt", target)
+
+	for _, bad := range []string{"/etc/passwd", "../../x", "../../../etc"} {
+		err = trans.makeSymlink(user, name, bad)
+		var pe *PathDeniedError
+		require.ErrorAs(t, err, &pe, bad)
+	}
+	target, err = os.Readlink(name)
+	require.NoError(t, err)
+	require.Equal(t, "b.txt", target)
+
+	// the links in the target are followed, b/.. is the parent of what b points to
+	b := filepath.Join(home, "tom", "sub", "b")
+	require.NoError(t, trans.makeSymlink(user, b, ".."))
+	require.NoError(t, trans.makeSymlink(user, name, "b/x"))
+	var pe *PathDeniedError
+	require.ErrorAs(t, trans.makeSymlink(user, name, "b/../x"), &pe)
+	require.ErrorAs(t, trans.makeSymlink(user, name, "b/../../x"), &pe)
+	require.NoError(t, trans.makeSymlink(user, name, "b/sub/../x"))
+	// a missing component may become a link later
+	require.ErrorAs(t, trans.makeSymlink(user, name, "missing/../x"), &pe)
+	loop := filepath.Join(home, "tom", "loop")
+	require.NoError(t, os.Symlink("loop", loop))
+	require.ErrorAs(t, trans.makeSymlink(user, name, "../loop/x"), &pe)
+}
@@ -0,0 +1,231 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// manifestBatchSize entries sent in one Trans.Manifest call
+const manifestBatchSize = 1000
+
+// ManifestEntry the stat of one client file for the initial sync
+type ManifestEntry struct {
+	Name  string      `json:"n"`
+	Size  int64       `json:"s,omitempty"`
+	Mtime time.Time   `json:"t"`
+	Md5   string      `json:"h,omitempty"`
+	IsDir bool        `json:"d,omitempty"`
+	Link  string      `json:"l,omitempty"`
+	Mode  os.FileMode `json:"m,omitempty"`
+
+	// Sample the hash of the first and last blocks for the quick+sample comparison
+	Sample string `json:"x,omitempty"`
+}
+
+// ManifestResult the names of the entries which are missing or different on the server
+type ManifestResult struct {
+	Differs []string
+
+	// Errs the error of each entry which can not be compared, by name
+	Errs map[string]string
+}
+
+// compareManifest compares the entries with the files of user, an entry
+// failed is reported in result.Errs and the others are still compared
+func (trans *Trans) compareManifest(user *ServerConfUser, entries []*ManifestEntry, compare string, result *ManifestResult) {
+	for _, entry := range entries {
+		fullName, _, err := trans.cleanFileName(user, entry.Name)
+		var differ bool
+		if err == nil {
+			differ, err = manifestDiffer(trans.index, fullName, entry, compare)
+		}
+		if err != nil {
+			glog.Warningln("trans.Manifest", entry.Name, "err:", err)
+			if result.Errs == nil {
+				result.Errs = make(map[string]string)
+			}
+			result.Errs[entry.Name] = err.Error()
+			continue
+		}
+		if differ {
+			result.Differs = append(result.Differs, entry.Name)
+		}
+	}
+}
+
+func encodeManifest(entries []*ManifestEntry) ([]byte, error) {
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return nil, err
+	}
+	return dataGzipEncode(data), nil
+}
+
+func decodeManifest(data []byte) ([]*ManifestEntry, error) {
+	raw, err := dataGzipDecode(data)
+	if err != nil {
+		return nil, err
+	}
+	var entries []*ManifestEntry
+	if err = json.Unmarshal(raw, &entries); err != nil {
+		return nil, fmt.Errorf("decode manifest: %w", err)
+	}
+	return entries, nil
+}
+
+// manifestDiffer reports whether the server file absPath is not same as entry,
+// the content is compared by the strategy compare
+func manifestDiffer(index *hashIndex, absPath string, entry *ManifestEntry, compare string) (bool, error) {
+	var stat FileStat
+	if entry.IsDir {
+		compare = compareQuick
+	}
+	if err := index.fileGetStatCompare(absPath, &stat, compare); err != nil {
+		return true, err
+	}
+	if !stat.Exists || stat.IsDir() != entry.IsDir || stat.IsLink() != (entry.Link != "") {
+		return true, nil
+	}
+	if entry.Link != "" {
+		return filepath.FromSlash(entry.Link) != stat.Link, nil
+	}
+	if stat.metaDiffer(&FileStat{FileMode: entry.Mode, Mtime: entry.Mtime, Link: entry.Link}) {
+		return true, nil
+	}
+	if entry.IsDir {
+		return false, nil
+	}
+	switch compare {
+	case compareQuick:
+		// the mtime is compared by metaDiffer above
+		return stat.Size != entry.Size, nil
+	case compareQuickSample:
+		return stat.Size != entry.Size || stat.Sample != entry.Sample, nil
+	}
+	return stat.Size != entry.Size || stat.Md5 != entry.Md5, nil
+}
+
+// syncManifest sends the stat of all local files in batches and queues
+// a check only for the files the server reports as different or fails to compare
+func (hc *HSyncClient) syncManifest() error {
+	start := time.Now()
+	var batch []*ManifestEntry
+	var total, differs, errs int
+	// a missing dir is sent with all its children by addNewDir
+	var missDirs []string
+	underMissDir := func(name string) bool {
+		for _, dir := range missDirs {
+			if strings.HasPrefix(name, dir+"/") {
+				return true
+			}
+		}
+		return false
+	}
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		data, err := encodeManifest(batch)
+		if err != nil {
+			return err
+		}
+		args := hc.NewArgs(".", nil)
+		args.Manifest = data
+		args.Compare = hc.conf.Compare
+		var result *ManifestResult
+		if err = hc.Call("Trans.Manifest", args, &result); err != nil {
+			return err
+		}
+		isDir := make(map[string]bool, len(batch))
+		for _, entry := range batch {
+			isDir[entry.Name] = entry.IsDir
+		}
+		hc.mu.Lock()
+		for _, name := range result.Differs {
+			if underMissDir(name) {
+				continue
+			}
+			if isDir[name] {
+				missDirs = append(missDirs, name)
+			}
+			hc.addEvent(filepath.Join(hc.conf.Home, filepath.FromSlash(name)), EventCheck, "")
+			differs++
+		}
+		// the entries the server failed to compare are checked one by one
+		for name, errEntry := range result.Errs {
+			glog.Warningln("sync manifest", name, "check it alone, server err:", errEntry)
+			if underMissDir(name) {
+				continue
+			}
+			hc.addEvent(filepath.Join(hc.conf.Home, filepath.FromSlash(name)), EventCheck, "")
+			errs++
+		}
+		hc.mu.Unlock()
+		total += len(batch)
+		batch = batch[:0]
+		glog.Infoln("sync manifest", total, "files checked,", differs, "differs,", errs, "errors")
+		return nil
+	}
+
+	err := syncWalk(hc.conf.Home, hc.conf.Symlink, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			glog.Warningf("walk %q with error %v and skipped", path, err)
+			return nil
+		}
+		_, relPath, _ := hc.CheckPath(path)
+		if relPath == "." {
+			return nil
+		}
+		if hc.conf.IsIgnore(relPath) {
+			glog.V(2).Infoln("sync ignore", relPath)
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		isLink := info.Mode()&os.ModeSymlink != 0
+		if !info.IsDir() && !info.Mode().IsRegular() && !isLink {
+			return nil
+		}
+		entry := &ManifestEntry{
+			Name:  filepath.ToSlash(relPath),
+			Mtime: info.ModTime(),
+			IsDir: info.IsDir(),
+			Mode:  info.Mode(),
+		}
+		if isLink {
+			link, err := os.Readlink(path)
+			if err != nil {
+				glog.Warningln("sync manifest read link failed:", err)
+				return nil
+			}
+			entry.Link = filepath.ToSlash(link)
+		} else if !entry.IsDir {
+			var stat FileStat
+			if err := hc.index.fileGetStatCompare(path, &stat, hc.conf.Compare); err != nil {
+				glog.Warningln("sync manifest get stat failed:", err)
+				return nil
+			}
+			entry.Size = stat.Size
+			entry.Md5 = stat.Md5
+			entry.Sample = stat.Sample
+		}
+		batch = append(batch, entry)
+		if len(batch) >= manifestBatchSize {
+			return flush()
+		}
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	glog.Infoln("sync manifest done,", total, "files,", differs, "differs,", errs, "errors, cost=", time.Since(start).String(), "err=", err)
+	return err
+}
@@ -0,0 +1,61 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestManifestDiffer(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "a.txt")
+	require.NoError(t, os.WriteFile(name, []byte("hello"), 0644))
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	require.NoError(t, os.Chtimes(name, mtime, mtime))
+	dirInfo, err := os.Stat(dir)
+	require.NoError(t, err)
+
+	data, err := encodeManifest([]*ManifestEntry{
+		{Name: "a.txt", Size: 5, Md5: StrMd5("hello"), Mode: 0644, Mtime: mtime},
+		{Name: "a.txt", Size: 5, Md5: StrMd5("world"), Mode: 0644, Mtime: mtime},
+		{Name: "a.txt", IsDir: true},
+		{Name: "b.txt", Size: 5, Md5: StrMd5("hello")},
+		{Name: ".", IsDir: true, Mode: dirInfo.Mode()},
+		{Name: "a.txt", Size: 5, Md5: StrMd5("hello"), Mode: 0755, Mtime: mtime},
+		{Name: "a.txt", Size: 5, Md5: StrMd5("hello"), Mode: 0644, Mtime: mtime.Add(time.Minute)},
+	})
+	require.NoError(t, err)
+	entries, err := decodeManifest(data)
+	require.NoError(t, err)
+
+	var got []bool
+	for _, entry := range entries {
+		differ, err := manifestDiffer(nil, filepath.Join(dir, entry.Name), entry, compareChecksum)
+		require.NoError(t, err)
+		got = append(got, differ)
+	}
+	require.Equal(t, []bool{false, true, true, true, false, true, true}, got)
+}
+
+func TestTrans_compareManifest(t *testing.T) {
+	home := t.TempDir()
+	trans := newTestTrans(home)
+	user := &ServerConfUser{Name: "tom", Root: "."}
+	require.NoError(t, os.WriteFile(filepath.Join(home, "a.txt"), []byte("hello"), 0644))
+	require.NoError(t, os.Symlink(t.TempDir(), filepath.Join(home, "out")))
+	entries := []*ManifestEntry{
+		{Name: "../x.txt", Size: 1},
+		{Name: "out/b.txt", Size: 1},
+		{Name: "a.txt", Size: 5, Md5: StrMd5("hello")},
+		{Name: "c.txt", Size: 1},
+	}
+	var result ManifestResult
+	trans.compareManifest(user, entries, compareChecksum, &result)
+	require.Equal(t, []string{"a.txt", "c.txt"}, result.Differs)
+	require.Len(t, result.Errs, 2)
+	require.Contains(t, result.Errs, "../x.txt")
+	require.Contains(t, result.Errs, "out/b.txt")
+}
@@ -0,0 +1,163 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// PathDeniedError is returned when a file name sent by a client
+// points outside the server home.
+type PathDeniedError struct {
+	Name   string
+	Reason string
+}
+
+func (e *PathDeniedError) Error() string {
+	return fmt.Sprintf("path %q denied: %s", e.Name, e.Reason)
+}
+
+// secureJoin joins the client supplied relative name to root.
+// Absolute names, ".." segments leaving root and symlinks resolving
+// outside root are all rejected with a *PathDeniedError.
+func secureJoin(root string, name string) (absPath string, relName string, err error) {
+	name = filepath.FromSlash(strings.TrimSpace(name))
+	if name == "" {
+		name = "."
+	}
+	if filepath.IsAbs(name) || filepath.VolumeName(name) != "" || strings.HasPrefix(name, string(filepath.Separator)) {
+		return "", "", &PathDeniedError{Name: name, Reason: "absolute path"}
+	}
+	relName = filepath.Clean(name)
+	if relName == ".." || strings.HasPrefix(relName, ".."+string(filepath.Separator)) {
+		return "", "", &PathDeniedError{Name: name, Reason: "escapes home"}
+	}
+	absPath = filepath.Join(root, relName)
+
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", "", err
+	}
+	// find the deepest path which exists, the rest of it can not be a symlink
+	exists := absPath
+	for {
+		if _, err = os.Lstat(exists); err == nil {
+			break
+		}
+		if !os.IsNotExist(err) {
+			return "", "", err
+		}
+		parent := filepath.Dir(exists)
+		if parent == exists {
+			break
+		}
+		exists = parent
+	}
+	realPath, err := filepath.EvalSymlinks(exists)
+	if err != nil && os.IsNotExist(err) && exists == absPath {
+		// a dangling symlink itself can be replaced or removed, its target is
+		// created later or never read
+		realPath, err = filepath.EvalSymlinks(filepath.Dir(absPath))
+	}
+	if err != nil {
+		if os.IsNotExist(err) {
+			// dangling symlink
+			return "", "", &PathDeniedError{Name: name, Reason: "broken symlink"}
+		}
+		return "", "", err
+	}
+	if !isSubPath(realRoot, realPath) {
+		return "", "", &PathDeniedError{Name: name, Reason: "symlink escapes home"}
+	}
+	return absPath, relName, nil
+}
+
+// isSubPath reports whether name is root or inside root, both must be clean.
+func isSubPath(root string, name string) bool {
+	rel, err := filepath.Rel(root, name)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
+
+// linkMaxHops the max links followed by resolveLinkTarget, same as the kernel
+const linkMaxHops = 40
+
+// resolveLinkTarget resolves the target of a link in dir as the kernel does,
+// one component at a time following the links which exist. A ".." after a
+// component which does not exist yet is rejected, it can not be resolved
+// until that component is created, maybe as a link.
+func resolveLinkTarget(dir string, target string) (string, error) {
+	cur, err := evalExisting(dir)
+	if err != nil {
+		return "", err
+	}
+	sep := string(filepath.Separator)
+	pending := strings.Split(target, sep)
+	var missing bool
+	var hops int
+	for len(pending) > 0 {
+		comp := pending[0]
+		pending = pending[1:]
+		switch comp {
+		case "", ".":
+			continue
+		case "..":
+			if missing {
+				return "", &PathDeniedError{Name: target, Reason: "symlink target goes up from a missing path"}
+			}
+			cur = filepath.Dir(cur)
+			continue
+		}
+		cur = filepath.Join(cur, comp)
+		if missing {
+			continue
+		}
+		info, err := os.Lstat(cur)
+		if os.IsNotExist(err) {
+			missing = true
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		if hops++; hops > linkMaxHops {
+			return "", &PathDeniedError{Name: target, Reason: "too many levels of symlinks"}
+		}
+		link, err := os.Readlink(cur)
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(link) {
+			cur = filepath.VolumeName(link) + sep
+		} else {
+			cur = filepath.Dir(cur)
+		}
+		pending = append(strings.Split(link, sep), pending...)
+	}
+	return cur, nil
+}
+
+// evalExisting resolves the links of the deepest part of name which exists,
+// the rest of it is joined as it is
+func evalExisting(name string) (string, error) {
+	name = filepath.Clean(name)
+	resolved, err := filepath.EvalSymlinks(name)
+	if err == nil {
+		return resolved, nil
+	}
+	parent := filepath.Dir(name)
+	if !os.IsNotExist(err) || parent == name {
+		return "", err
+	}
+	resolved, err = evalExisting(parent)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(resolved, filepath.Base(name)), nil
+}
@@ -0,0 +1,49 @@
+package internal
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSecureJoin(t *testing.T) {
+	base := t.TempDir()
+	home := filepath.Join(base, "home")
+	require.NoError(t, os.MkdirAll(filepath.Join(home, "a"), 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(base, "outside"), 0755))
+	require.NoError(t, os.Symlink(filepath.Join(base, "outside"), filepath.Join(home, "out")))
+	require.NoError(t, os.Symlink("a", filepath.Join(home, "in")))
+	require.NoError(t, os.Symlink("a/not-exist", filepath.Join(home, "dangling")))
+
+	allowed := map[string]string{
+		".":           ".",
+		"a/b.txt":     "a/b.txt",
+		"a/../c.txt":  "c.txt",
+		"in/new/d.go": "in/new/d.go",
+		"dangling":    "dangling",
+	}
+	for name, rel := range allowed {
+		abs, relName, err := secureJoin(home, name)
+		require.NoError(t, err, name)
+		require.Equal(t, filepath.FromSlash(rel), relName)
+		require.Equal(t, filepath.Join(home, rel), abs)
+	}
+
+	denied := []string{
+		"/etc/passwd",
+		"..",
+		"../outside/x",
+		"a/../../x",
+		"out",
+		"out/x.txt",
+		"dangling/x",
+	}
+	for _, name := range denied {
+		_, _, err := secureJoin(home, name)
+		var pe *PathDeniedError
+		require.True(t, errors.As(err, &pe), "%s: %v", name, err)
+	}
+}
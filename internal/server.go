@@ -1,22 +1,25 @@
 package internal
 
 import (
-	"bytes"
+	"context"
+	"crypto/tls"
 	"net"
 	"net/http"
 	"net/rpc"
 	"os"
 	"os/exec"
-	"regexp"
-	"strings"
+	"path/filepath"
 
 	"github.com/golang/glog"
 )
 
 type HSyncServer struct {
-	conf          *ServerConf
-	deployCmdArgs []string
-	trans         *Trans
+	conf   *ServerConf
+	trans  *Trans
+	runner *deployRunner
+
+	// releases the state of the release deploys, used by the event loop only
+	releases map[*ServerConfDeploy]*releaseState
 }
 
 func NewHSyncServer(confName string) (*HSyncServer, error) {
@@ -25,10 +28,34 @@ func NewHSyncServer(confName string) (*HSyncServer, error) {
 		return nil, err
 	}
 	checkDir(conf.Home, 0755)
-	err = os.Chdir(conf.Home)
+	for _, u := range conf.users {
+		if err = checkDir(filepath.Join(conf.Home, u.Root), 0755); err != nil {
+			return nil, err
+		}
+	}
+	server, err := newHSyncServer(conf)
 	if err != nil {
 		return nil, err
 	}
+	server.trans = NewTrans(server)
+	rpc.Register(server.trans)
+	return server, nil
+}
+
+// NewDeployServer loads the server for -deploy and -rollback,
+// it creates no dir and starts no trans, so a dry-run changes nothing on disk
+func NewDeployServer(confName string) (*HSyncServer, error) {
+	conf, err := LoadServerConf(confName)
+	if err != nil {
+		return nil, err
+	}
+	return newHSyncServer(conf)
+}
+
+func newHSyncServer(conf *ServerConf) (*HSyncServer, error) {
+	if err := os.Chdir(conf.Home); err != nil {
+		return nil, err
+	}
 	pwd, err := os.Getwd()
 	if err != nil {
 		return nil, err
@@ -37,10 +64,7 @@ func NewHSyncServer(confName string) (*HSyncServer, error) {
 	server := &HSyncServer{
 		conf: conf,
 	}
-	server.trans = NewTrans(server)
-	rpc.Register(server.trans)
-	reg := regexp.MustCompile(`\s+`)
-	server.deployCmdArgs = reg.Split(strings.TrimSpace(conf.DeployCmd), -1)
+	server.runner = newDeployRunner(conf.DeployWorkers)
 	return server, nil
 }
 
@@ -51,7 +75,17 @@ func (server *HSyncServer) Start() error {
 	if err != nil {
 		return err
 	}
+	if server.conf.TLS != nil {
+		tlsConf, err := server.conf.TLS.tlsConfig()
+		if err != nil {
+			l.Close()
+			return err
+		}
+		l = tls.NewListener(l, tlsConf)
+		glog.Infoln("hsync server tls enabled, mutual:", server.conf.TLS.isMutual())
+	}
 	http.HandleFunc("/", server.handlerIndex)
+	http.HandleFunc(tarPushPath, server.trans.handleTarPush)
 	return http.Serve(l, nil)
 }
 
@@ -63,44 +97,71 @@ func (server *HSyncServer) handlerIndex(w http.ResponseWriter, r *http.Request)
 	w.Write([]byte("</pre>"))
 }
 
-func (server *HSyncServer) DeployAll() {
-	glog.Infoln("deploy all start")
-	for _, dc := range server.conf.Deploy {
-		server.deploy(dc.To, dc.From)
-	}
-	glog.Infoln("deploy all done")
-}
-
-func (server *HSyncServer) deploy(dst, src string) {
+// deploy copies job.Src to job.Dst, the files filtered out by the deploy are not copied,
+// job is returned when it is done
+func (server *HSyncServer) deploy(job *deployJob) *deployJob {
 	var err error
 	os.Chdir(server.conf.Home)
-	err = copyFile(dst, src)
+	err = copyFileSkip(job.Dst, job.Src, func(name string, info os.FileInfo) bool {
+		return !job.Deploy.match(name, info.IsDir())
+	})
 	pwd, _ := os.Getwd()
-	glog.Infof("deploy Copy [%s]->[%s],err=%v, pwd=%s", src, dst, err, pwd)
+	glog.Infof("deploy Copy [%s]->[%s],err=%v, pwd=%s", job.Src, job.Dst, err, pwd)
 	if err != nil {
-		return
+		return nil
 	}
+	server.runDeployCmd(job)
+	return job
+}
 
-	if server.conf.DeployCmd == "" {
-		return
+// deployCmdArgs returns the deployCmd of job expanded and its vars, nil when there is none
+func (server *HSyncServer) deployCmdArgs(job *deployJob) (cmdArgs []string, vars map[string]string) {
+	deployCmd := job.Deploy.DeployCmd
+	if len(deployCmd) == 0 {
+		deployCmd = server.conf.DeployCmd
+	}
+	if len(deployCmd) == 0 {
+		return nil, nil
 	}
 
-	cmdArgs := make([]string, len(server.deployCmdArgs)-1)
-	copy(cmdArgs, server.deployCmdArgs[1:])
-
-	cmdArgs = append(cmdArgs, dst)
-	cmdArgs = append(cmdArgs, src)
-	cmdArgs = append(cmdArgs, "update")
-
-	cmd := exec.Command(server.deployCmdArgs[0], cmdArgs...)
-	cmd.Dir = server.conf.Home
+	vars = server.deployCmdVars(job)
+	cmdArgs, named := expandDeployCmd(deployCmd, vars)
+	if !named {
+		cmdArgs = append(cmdArgs, job.Dst, job.Src, job.Event)
+		if job.OldDst != "" {
+			cmdArgs = append(cmdArgs, job.OldDst)
+		}
+	}
+	return cmdArgs, vars
+}
 
-	var out bytes.Buffer
-	cmd.Stdout = &out
+// runDeployCmd runs the deployCmd of job.Deploy, or the global one.
+// A command without named placeholders gets dst, src and the event appended,
+// a rename also gets the old dst.
+func (server *HSyncServer) runDeployCmd(job *deployJob) {
+	cmdArgs, vars := server.deployCmdArgs(job)
+	if len(cmdArgs) == 0 {
+		return
+	}
 
-	var outErr bytes.Buffer
-	cmd.Stderr = &outErr
-	err = cmd.Run()
-	glog.Infof("deployCmd [%s]->[%s],err=%v", src, dst, err)
-	glog.V(2).Infoln("deployCmd", cmdArgs, "deploy stdOut:", out.String(), "stdErrOut:", outErr.String(), "err=", err)
+	dir := server.conf.Home
+	if job.Deploy.Dir != "" {
+		dir = server.conf.homePath(job.Deploy.Dir)
+	}
+	env := deployCmdEnv(vars, job.Deploy.Env)
+	newCmd := func(ctx context.Context) *exec.Cmd {
+		cmd := exec.CommandContext(ctx, cmdArgs[0], cmdArgs[1:]...)
+		cmd.Dir = dir
+		cmd.Env = env
+		return cmd
+	}
+	server.runner.submit(job.Dst, func() {
+		res := server.execDeployCmd(job, newCmd)
+		if server.trans != nil {
+			server.trans.stats.addDeployResult(job.Deploy.key(), res, server.conf.DeployResults)
+		}
+		if job.onResult != nil {
+			job.onResult(res)
+		}
+	})
 }
@@ -1,9 +1,14 @@
 package internal
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 
 	"github.com/fsgo/fsconf"
@@ -16,7 +21,46 @@ type ServerConf struct {
 	Token     string              `json:"token"`
 	Deploy    []*ServerConfDeploy `json:"deploy"`
 	ConfDir   string
-	DeployCmd string `json:"deployCmd"`
+	DeployCmd CmdArgs `json:"deployCmd"`
+
+	TLS *ServerConfTLS `json:"tls"`
+
+	Users []*ServerConfUser `json:"users"`
+	users []*ServerConfUser
+
+	// UploadTimeout seconds, abandoned partial uploads are removed after it, default is 600
+	UploadTimeout int `json:"uploadTimeout"`
+
+	// StateDir saves the server state such as upload sessions, default is ".hsyncd" in ConfDir
+	StateDir string `json:"stateDir"`
+
+	// BlobCacheSize MB of the content cache in StateDir, default is 1024, disabled when < 0
+	BlobCacheSize int `json:"blobCacheSize"`
+
+	// DeployTimeout seconds, a deployCmd running longer is killed, default is 60, no timeout when < 0
+	DeployTimeout int `json:"deployTimeout"`
+
+	// DeployWorkers the max deployCmds running at the same time, default is 4
+	DeployWorkers int `json:"deployWorkers"`
+
+	// DeployRetries times a failed deployCmd is run again, with backoff from 1s
+	DeployRetries int `json:"deployRetries"`
+
+	// DeployResults the last results of deployCmd kept for each deploy, default is 20
+	DeployResults int `json:"deployResults"`
+
+	// DeploySettle ms, the changes are deployed after no file is received for it, default is 500
+	DeploySettle int `json:"deploySettle"`
+
+	// DeployMaxWait ms, the changes are deployed at most this long after the first one, default is 5000
+	DeployMaxWait int `json:"deployMaxWait"`
+
+	// BatchDeployCmd runs once after the files changed together are deployed,
+	// with the list of them on stdin and in a temp file
+	BatchDeployCmd CmdArgs `json:"batchDeployCmd"`
+
+	// BatchDeployFormat the format of the list: json or lines, default is json
+	BatchDeployFormat string `json:"batchDeployFormat"`
 }
 
 func (cfg *ServerConf) AutoCheck() error {
@@ -24,19 +68,257 @@ func (cfg *ServerConf) AutoCheck() error {
 		return errors.New("server listen addr is empty")
 	}
 
-	for _, deploy := range cfg.Deploy {
+	for i, deploy := range cfg.Deploy {
 		deploy.From = strings.Trim(deploy.From, "/")
+		if err := deploy.parse(); err != nil {
+			return fmt.Errorf("deploy[%d]: %w", i, err)
+		}
+	}
+
+	if cfg.UploadTimeout <= 0 {
+		cfg.UploadTimeout = 600
+	}
+	if cfg.BlobCacheSize == 0 {
+		cfg.BlobCacheSize = 1024
+	}
+	if cfg.DeployTimeout == 0 {
+		cfg.DeployTimeout = 60
+	}
+	if cfg.DeployWorkers <= 0 {
+		cfg.DeployWorkers = 4
+	}
+	if cfg.DeployRetries < 0 {
+		cfg.DeployRetries = 0
+	}
+	if cfg.DeployResults <= 0 {
+		cfg.DeployResults = 20
+	}
+	if cfg.DeploySettle <= 0 {
+		cfg.DeploySettle = 500
+	}
+	if cfg.DeployMaxWait <= 0 {
+		cfg.DeployMaxWait = 5000
+	}
+	switch cfg.BatchDeployFormat {
+	case "":
+		cfg.BatchDeployFormat = batchDeployJSON
+	case batchDeployJSON, batchDeployLines:
+	default:
+		return fmt.Errorf("invalid batchDeployFormat %q", cfg.BatchDeployFormat)
+	}
+
+	if cfg.TLS != nil && cfg.TLS.CertFile == "" && !cfg.TLS.Auto {
+		return errors.New("tls.certFile is empty")
+	}
+	if cfg.Token == "" && !cfg.TLS.isMutual() && len(cfg.Users) == 0 {
+		glog.Warningln("token is empty and mutual tls is not enabled, anyone can write files")
 	}
 
+	return cfg.parseUsers()
+}
+
+// parseUsers builds the users allowed to login, the global token is the
+// "default" user which owns the whole home. Without the global token the
+// default user is only added when no users are configured, a client cert
+// of mutual tls does not bypass the users.
+func (cfg *ServerConf) parseUsers() error {
+	cfg.users = cfg.users[:0]
+	if cfg.Token != "" || len(cfg.Users) == 0 {
+		cfg.users = append(cfg.users, &ServerConfUser{
+			Name:  "default",
+			Token: cfg.Token,
+			Root:  ".",
+			key:   authKey(cfg.Token),
+		})
+	}
+	keys := make(map[string]string)
+	for _, u := range cfg.users {
+		keys[string(u.key)] = u.Name
+	}
+	for i, u := range cfg.Users {
+		if err := u.parse(); err != nil {
+			return fmt.Errorf("users[%d]: %w", i, err)
+		}
+		if name, has := keys[string(u.key)]; has {
+			return fmt.Errorf("users[%d]: token is same as user %q", i, name)
+		}
+		keys[string(u.key)] = u.Name
+		cfg.users = append(cfg.users, u)
+	}
 	return nil
 }
 
 var _ fsconf.AutoChecker = (*ServerConf)(nil)
 
+const (
+	permRead   = "read"
+	permWrite  = "write"
+	permDelete = "delete"
+	permDeploy = "deploy"
+)
+
+// ServerConfUser one client allowed to login, it can only access files under Root
+type ServerConfUser struct {
+	Name  string `json:"name"`
+	Token string `json:"token"`
+
+	// TokenHash hex sha256 of the token, used when Token is empty
+	TokenHash string `json:"tokenHash"`
+
+	// Root sub directory of home, default is home
+	Root string `json:"root"`
+
+	// Perms allowed operations: read, write, delete, deploy. empty means all
+	Perms []string `json:"perms"`
+
+	key []byte
+}
+
+func (u *ServerConfUser) parse() error {
+	if u.Name == "" {
+		return errors.New("name is empty")
+	}
+	switch {
+	case u.Token != "":
+		u.key = authKey(u.Token)
+	case u.TokenHash != "":
+		key, err := hex.DecodeString(strings.TrimSpace(u.TokenHash))
+		if err != nil || len(key) != sha256.Size {
+			return fmt.Errorf("user %q: invalid tokenHash", u.Name)
+		}
+		u.key = key
+	default:
+		return fmt.Errorf("user %q: token and tokenHash are both empty", u.Name)
+	}
+
+	root := filepath.Clean(filepath.FromSlash(strings.TrimSpace(u.Root)))
+	if filepath.IsAbs(root) || root == ".." || strings.HasPrefix(root, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("user %q: root %q must be a sub directory of home", u.Name, u.Root)
+	}
+	u.Root = root
+
+	for _, p := range u.Perms {
+		switch p {
+		case permRead, permWrite, permDelete, permDeploy:
+		default:
+			return fmt.Errorf("user %q: unknown perm %q", u.Name, p)
+		}
+	}
+	return nil
+}
+
+func (u *ServerConfUser) can(perm string) bool {
+	return len(u.Perms) == 0 || slices.Contains(u.Perms, perm)
+}
+
 type ServerConfDeploy struct {
 	From  string `json:"from"`
 	To    string `json:"to"`
 	IsDir bool
+
+	// KeepDeletes the deletes are not mirrored into To, which only grows
+	KeepDeletes bool `json:"keepDeletes"`
+
+	// Mirror the files in To which are not in From are removed by the full deploy
+	Mirror bool `json:"mirror"`
+
+	// Release each deploy is built into To/releases/<time>, the files unchanged
+	// are hardlinked from the previous release, then To/current is switched to it
+	Release bool `json:"release"`
+
+	// KeepReleases the number of releases kept, default is 5
+	KeepReleases int `json:"keepReleases"`
+
+	// ReleaseInterval seconds, the min time between two releases built by the
+	// changes, the changes in it are released together after it
+	ReleaseInterval int `json:"releaseInterval"`
+
+	// Ignore and Allow filter the files deployed, same as the client's,
+	// the names matched are relative to From
+	Ignore   []string `json:"ignore"`
+	Allow    []string `json:"allow"`
+	ignoreCr *ConfRegexp
+	allowCr  *ConfRegexp
+
+	// DeployCmd runs after each deploy of this entry instead of the global deployCmd
+	DeployCmd CmdArgs `json:"deployCmd"`
+
+	// Dir the working dir of deployCmd, relative to home, default is home
+	Dir string `json:"dir"`
+
+	// Env the extra environment variables of deployCmd
+	Env map[string]string `json:"env"`
+}
+
+// key names the deploy in the status
+func (deploy *ServerConfDeploy) key() string {
+	return deploy.From + " -> " + deploy.To
+}
+
+func (deploy *ServerConfDeploy) parse() error {
+	if deploy.Mirror && deploy.KeepDeletes {
+		return errors.New("mirror and keepDeletes can not be both enabled")
+	}
+	if deploy.Release && deploy.KeepDeletes {
+		return errors.New("release and keepDeletes can not be both enabled")
+	}
+	if deploy.KeepReleases <= 0 {
+		deploy.KeepReleases = 5
+	}
+	if deploy.ReleaseInterval < 0 {
+		deploy.ReleaseInterval = 0
+	}
+	var err error
+	if deploy.ignoreCr, err = NewCongRegexp(deploy.Ignore); err != nil {
+		return fmt.Errorf("parser Ignore: %w", err)
+	}
+	if len(deploy.Allow) > 0 {
+		if deploy.allowCr, err = NewCongRegexp(deploy.Allow); err != nil {
+			return fmt.Errorf("parser Allow: %w", err)
+		}
+	}
+	return nil
+}
+
+// match reports whether relName passes the ignore and allow of the deploy,
+// allow is not checked for dirs since they hold the files allowed
+func (deploy *ServerConfDeploy) match(relName string, isDir bool) bool {
+	rel, err := filepath.Rel(strings.TrimLeft(deploy.From, "/"), relName)
+	if err != nil {
+		return false
+	}
+	if rel == "." {
+		return true
+	}
+	if deploy.ignoreCr != nil && deploy.ignoreCr.IsMatch(rel) {
+		return false
+	}
+	if !isDir && deploy.allowCr != nil && !deploy.allowCr.IsMatch(rel) {
+		return false
+	}
+	return true
+}
+
+// target returns the deploy path of relName, ok is false when relName is not under From
+func (deploy *ServerConfDeploy) target(relName string) (dst string, ok bool) {
+	from := strings.TrimLeft(deploy.From, "/")
+	if deploy.From != "." && !isSubPath(from, relName) {
+		return "", false
+	}
+	rel, err := filepath.Rel(from, relName)
+	if err != nil {
+		glog.Warningln("deploy wrong path,relName:", relName, "deploy:", deploy)
+		return "", false
+	}
+	return filepath.Join(deploy.current(), rel), true
+}
+
+// current returns the dir the files are deployed into, To/current for a release deploy
+func (deploy *ServerConfDeploy) current() string {
+	if deploy.Release {
+		return filepath.Join(deploy.To, releaseCurrent)
+	}
+	return deploy.To
 }
 
 func LoadServerConf(name string) (cfg *ServerConf, err error) {
@@ -44,7 +326,8 @@ func LoadServerConf(name string) (cfg *ServerConf, err error) {
 	if err != nil {
 		return nil, err
 	}
-	err = fsconf.Parse(fp, &cfg)
+	cfg = &ServerConf{}
+	err = fsconf.Parse(fp, cfg)
 	if err != nil {
 		return nil, err
 	}
@@ -54,7 +337,13 @@ func LoadServerConf(name string) (cfg *ServerConf, err error) {
 		cfg.Home = filepath.Join(cfg.ConfDir, cfg.Home)
 	}
 	cfg.Home = filepath.Clean(cfg.Home)
-	cfg.DeployCmd = strings.TrimSpace(strings.ReplaceAll(cfg.DeployCmd, "{pwd}", cfg.ConfDir))
+	if cfg.TLS != nil {
+		cfg.TLS.parse(cfg.ConfDir)
+	}
+	if cfg.StateDir == "" {
+		cfg.StateDir = ".hsyncd"
+	}
+	cfg.StateDir = confPath(cfg.ConfDir, cfg.StateDir)
 	glog.V(2).Info("load cfg [", name, "]suc,", cfg)
 
 	return cfg, nil
@@ -65,20 +354,49 @@ func (cfg *ServerConf) String() string {
 	return string(data)
 }
 
-func (cfg *ServerConf) getDeployTo(relName string) []string {
-	var deployTo []string
+// deployTarget one deploy path of a file and the deploy entry it matched
+type deployTarget struct {
+	Deploy *ServerConfDeploy
+	Dst    string
+}
+
+// deployTarget returns the deploy path of relName, ok is false when relName
+// is not under From or filtered out by the deploy
+func (cfg *ServerConf) deployTarget(deploy *ServerConfDeploy, relName string) (dst string, ok bool) {
+	dst, ok = deploy.target(relName)
+	if !ok {
+		return "", false
+	}
+	// a deleted file is checked by what it was deployed as
+	info, err := os.Lstat(filepath.Join(cfg.Home, relName))
+	if err != nil {
+		info, err = os.Lstat(cfg.homePath(dst))
+	}
+	return dst, deploy.match(relName, err == nil && info.IsDir())
+}
+
+// homePath returns name relative to home as an absolute path
+func (cfg *ServerConf) homePath(name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(cfg.Home, name)
+}
+
+func (cfg *ServerConf) getDeployTargets(relName string) []*deployTarget {
+	var targets []*deployTarget
 	for _, deploy := range cfg.Deploy {
-		from := strings.TrimLeft(deploy.From, "/")
-		if deploy.From != "." && !strings.HasPrefix(relName, from) {
-			continue
-		}
-		rel, err := filepath.Rel(from, relName)
-		if err != nil {
-			glog.Warningln("deploy wrong path,relName:", relName, "deploy:", deploy)
-			continue
+		if destPath, ok := cfg.deployTarget(deploy, relName); ok {
+			targets = append(targets, &deployTarget{Deploy: deploy, Dst: destPath})
 		}
-		destPath := filepath.Join(deploy.To, rel)
-		deployTo = append(deployTo, destPath)
+	}
+	return targets
+}
+
+func (cfg *ServerConf) getDeployTo(relName string) []string {
+	var deployTo []string
+	for _, target := range cfg.getDeployTargets(relName) {
+		deployTo = append(deployTo, target.Dst)
 	}
 	return deployTo
 }
@@ -5,6 +5,9 @@
 package internal
 
 import (
+	"encoding/hex"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -37,3 +40,60 @@ func TestServerConf_getDeployTo(t *testing.T) {
 		require.Equal(t, want1, got1)
 	})
 }
+
+func TestServerConf_parseUsers(t *testing.T) {
+	cfg := &ServerConf{
+		Token: "t0",
+		Users: []*ServerConfUser{
+			{Name: "u1", Token: "t1", Root: "u1/", Perms: []string{"read", "write"}},
+			{Name: "u2", TokenHash: hex.EncodeToString(authKey("t2")), Root: "u2"},
+		},
+	}
+	require.NoError(t, cfg.parseUsers())
+	require.Len(t, cfg.users, 3)
+	require.Equal(t, "default", cfg.users[0].Name)
+	require.Equal(t, authKey("t2"), cfg.users[2].key)
+	require.True(t, cfg.users[1].can(permWrite))
+	require.False(t, cfg.users[1].can(permDelete))
+	require.True(t, cfg.users[2].can(permDeploy))
+
+	// mutual tls without the global token only allows the users configured
+	mtls := &ServerConf{
+		TLS:   &ServerConfTLS{ClientCA: "ca.crt"},
+		Users: []*ServerConfUser{{Name: "u1", Token: "t1", Root: "u1"}},
+	}
+	require.NoError(t, mtls.parseUsers())
+	require.Len(t, mtls.users, 1)
+	require.Equal(t, "u1", mtls.users[0].Name)
+	mtls.Users = nil
+	require.NoError(t, mtls.parseUsers())
+	require.Equal(t, "default", mtls.users[0].Name)
+
+	bad := []*ServerConfUser{
+		{Name: "a", Token: "t", Root: "../x"},
+		{Name: "b", Token: "t", Root: "/x"},
+		{Name: "c", Root: "x"},
+		{Name: "d", Token: "t0"},
+		{Name: "e", Token: "t", Perms: []string{"all"}},
+	}
+	for _, u := range bad {
+		cfg := &ServerConf{Token: "t0", Users: []*ServerConfUser{u}}
+		require.Error(t, cfg.parseUsers(), u.Name)
+	}
+}
+
+func TestTrans_cleanFileName(t *testing.T) {
+	home := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(home, "u1"), 0755))
+	trans := &Trans{server: &HSyncServer{conf: &ServerConf{Home: home}}}
+	user := &ServerConfUser{Name: "u1", Root: "u1"}
+
+	abs, rel, err := trans.cleanFileName(user, "a/b.txt")
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(home, "u1/a/b.txt"), abs)
+	require.Equal(t, filepath.FromSlash("u1/a/b.txt"), rel)
+
+	_, _, err = trans.cleanFileName(user, "../u2/b.txt")
+	var pe *PathDeniedError
+	require.ErrorAs(t, err, &pe)
+}
@@ -0,0 +1,341 @@
+package internal
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// tarPushPath the http path receiving the gzipped tar of the client home
+const tarPushPath = "/_hsync_push"
+
+// tarPushMethod the method name signed for a tar push
+const tarPushMethod = "Trans.TarPush"
+
+// the headers carrying the session credential of a tar push,
+// the sign covers them with FileName=tarPushPath
+const (
+	headerSession = "X-Hsync-Session"
+	headerTime    = "X-Hsync-Time"
+	headerSeq     = "X-Hsync-Seq"
+	headerSign    = "X-Hsync-Sign"
+
+	// headerBodySign the trailer carrying the HMAC of the tar body
+	headerBodySign = "X-Hsync-Body-Sign"
+)
+
+var clientTarPush bool
+
+func init() {
+	flag.BoolVar(&clientTarPush, "push", false, "send all files as one tar stream on start, even the server home is not empty")
+}
+
+// TarPushResult the response of a tar push
+type TarPushResult struct {
+	Files   int   `json:"files"`
+	Dirs    int   `json:"dirs"`
+	Bytes   int64 `json:"bytes"`
+	Skipped int   `json:"skipped"`
+}
+
+func (trans *Trans) handleTarPush(w http.ResponseWriter, r *http.Request) {
+	var result TarPushResult
+	var err error
+	defer func() {
+		trans.stats.add("TarPush", fmt.Sprintf("%d files, %d dirs, %d bytes", result.Files, result.Dirs, result.Bytes), err)
+	}()
+	if r.Method != http.MethodPost {
+		err = errors.New("method not allowed")
+		http.Error(w, err.Error(), http.StatusMethodNotAllowed)
+		return
+	}
+	arg := &RpcArgs{
+		Session:  r.Header.Get(headerSession),
+		Sign:     r.Header.Get(headerSign),
+		FileName: tarPushPath,
+	}
+	arg.Time, _ = strconv.ParseInt(r.Header.Get(headerTime), 10, 64)
+	arg.Seq, _ = strconv.ParseUint(r.Header.Get(headerSeq), 10, 64)
+	user, err := trans.checkToken(tarPushMethod, arg, permWrite)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	glog.Infoln("trans.TarPush start, user:", user.Name, "from", r.RemoteAddr)
+	mac, err := trans.auth.bodyMac(arg)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	// nothing is written before the body sign in the trailer is checked
+	body, err := trans.spoolTar(r.Body, mac)
+	if err != nil {
+		glog.Warningln("trans.TarPush read body failed:", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer func() {
+		body.Close()
+		os.Remove(body.Name())
+	}()
+	if !hmac.Equal([]byte(r.Trailer.Get(headerBodySign)), []byte(hex.EncodeToString(mac.Sum(nil)))) {
+		err = errors.New("body sign not match")
+		glog.Warningln("trans.TarPush failed:", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	err = trans.unpackTar(user, body, &result)
+	if err != nil {
+		glog.Warningln("trans.TarPush failed:", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	glog.Infof("trans.TarPush done, %d files, %d dirs, %d bytes, %d skipped", result.Files, result.Dirs, result.Bytes, result.Skipped)
+	json.NewEncoder(w).Encode(&result)
+}
+
+// spoolTar saves the tar body r in a temp file under StateDir and sums it with mac,
+// the file is returned at its start
+func (trans *Trans) spoolTar(r io.Reader, mac hash.Hash) (*os.File, error) {
+	dir := trans.server.conf.StateDir
+	if err := checkDir(dir, 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(dir, "tarpush-*")
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(f, io.TeeReader(r, mac))
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return f, nil
+}
+
+// unpackTar writes the gzipped tar r into the root of user,
+// each entry is checked by cleanFileName and queued for deploy
+func (trans *Trans) unpackTar(user *ServerConfUser, r io.Reader, result *TarPushResult) error {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gr.Close()
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fullName, relName, err := trans.cleanFileName(user, hdr.Name)
+		if err != nil {
+			return err
+		}
+		mode := hdr.FileInfo().Mode()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err = checkDir(fullName, mode.Perm()); err != nil {
+				return err
+			}
+			result.Dirs++
+		case tar.TypeSymlink:
+			err = trans.makeSymlink(user, fullName, hdr.Linkname)
+			var pe *PathDeniedError
+			if errors.As(err, &pe) {
+				glog.Warningf("trans.TarPush skip symlink [%s]: %v", hdr.Name, err)
+				result.Skipped++
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			result.Files++
+		case tar.TypeReg:
+			if err = replaceFile(fullName, tr, &FileStat{FileMode: mode, Mtime: hdr.ModTime}); err != nil {
+				return err
+			}
+			result.Files++
+			result.Bytes += hdr.Size
+		default:
+			glog.Warningf("trans.TarPush skip [%s], type %c not supported", hdr.Name, hdr.Typeflag)
+			result.Skipped++
+			continue
+		}
+		trans.addEvent(user, relName, EventUpdate)
+	}
+}
+
+// shouldTarPush reports whether the initial sync sends the whole home as a tar,
+// when forced by -push or the server home is empty
+func (hc *HSyncClient) shouldTarPush() bool {
+	if clientTarPush {
+		return true
+	}
+	empty, err := hc.remoteHomeEmpty()
+	if err != nil {
+		glog.Warningln("list server home failed:", err)
+		return false
+	}
+	if empty {
+		glog.Infoln("server home is empty, push all files as tar")
+	}
+	return empty
+}
+
+// remoteHomeEmpty reports whether the server home has no file the client would sync
+func (hc *HSyncClient) remoteHomeEmpty() (bool, error) {
+	var list *DirList
+	if err := hc.Call("Trans.DirList", hc.NewArgs(".", nil), &list); err != nil {
+		return false, err
+	}
+	for _, name := range list.Files {
+		if !hc.conf.IsIgnore(filepath.FromSlash(name)) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// tarPush sends the whole home, without the ignored files, as one gzipped tar
+func (hc *HSyncClient) tarPush() error {
+	start := time.Now()
+	args := hc.NewArgs(tarPushPath, nil)
+	for hc.client == nil {
+		if err := hc.Connect(); err != nil {
+			return err
+		}
+	}
+	if err := hc.signArgs(tarPushMethod, args); err != nil {
+		return err
+	}
+
+	scheme := "http"
+	var tlsConf *tls.Config
+	if hc.remoteHost.TLS != nil {
+		var err error
+		if tlsConf, err = hc.remoteHost.TLS.tlsConfig(hc.remoteHost.Host); err != nil {
+			return err
+		}
+		scheme = "https"
+	}
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	req, err := http.NewRequest(http.MethodPost, scheme+"://"+hc.remoteHost.Host+tarPushPath, pr)
+	if err != nil {
+		return err
+	}
+	// the trailer is filled before the body ends
+	req.Trailer = http.Header{headerBodySign: nil}
+	mac := hc.auth.bodyMac(args)
+	go func() {
+		err := hc.writeTar(io.MultiWriter(pw, mac))
+		if err == nil {
+			req.Trailer.Set(headerBodySign, hex.EncodeToString(mac.Sum(nil)))
+		}
+		pw.CloseWithError(err)
+	}()
+	req.Header.Set("Content-Type", "application/gzip")
+	req.Header.Set(headerSession, args.Session)
+	req.Header.Set(headerTime, strconv.FormatInt(args.Time, 10))
+	req.Header.Set(headerSeq, strconv.FormatUint(args.Seq, 10))
+	req.Header.Set(headerSign, args.Sign)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConf}}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("tar push failed: %s, %s", resp.Status, msg)
+	}
+	var result TarPushResult
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return err
+	}
+	glog.Infof("tar push done, %d files, %d dirs, %d bytes, %d skipped, cost=%s", result.Files, result.Dirs, result.Bytes, result.Skipped, time.Since(start).String())
+	hc.RemoteFlush()
+	return nil
+}
+
+func (hc *HSyncClient) writeTar(w io.Writer) error {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	err := syncWalk(hc.conf.Home, hc.conf.Symlink, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			glog.Warningf("walk %q with error %v and skipped", path, err)
+			return nil
+		}
+		_, relPath, _ := hc.CheckPath(path)
+		if relPath == "." {
+			return nil
+		}
+		if hc.conf.IsIgnore(relPath) {
+			glog.V(2).Infoln("tar push ignore", relPath)
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		} else if !info.IsDir() && !info.Mode().IsRegular() {
+			glog.Infoln("tar push skip", relPath, "mode", info.Mode())
+			return nil
+		}
+		hdr, err := tar.FileInfoHeader(info, filepath.ToSlash(link))
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(relPath)
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if info.IsDir() || link != "" {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		// a file growing while it is read is cut at the size in the header
+		_, err = io.CopyN(tw, f, hdr.Size)
+		return err
+	})
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = gw.Close()
+	}
+	return err
+}
@@ -0,0 +1,137 @@
+package internal
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testTarEntry struct {
+	name string
+	mode int64
+	typ  byte
+	data string
+}
+
+func buildTestTar(t *testing.T, entries []testTarEntry) *bytes.Buffer {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: e.mode, Typeflag: e.typ, Size: int64(len(e.data))}
+		if e.typ == tar.TypeSymlink {
+			hdr.Linkname, hdr.Size = e.data, 0
+		}
+		require.NoError(t, tw.WriteHeader(hdr))
+		if hdr.Size > 0 {
+			_, err := tw.Write([]byte(e.data))
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+	return &buf
+}
+
+func TestTrans_unpackTar(t *testing.T) {
+	home := t.TempDir()
+	trans := newTestTrans(home)
+	user := &ServerConfUser{Name: "tom", Root: "tom"}
+	require.NoError(t, os.Mkdir(filepath.Join(home, "tom"), 0755))
+	buf := buildTestTar(t, []testTarEntry{
+		{name: "sub/", mode: 0755, typ: tar.TypeDir},
+		{name: "sub/a.sh", mode: 0700, typ: tar.TypeReg, data: "echo hi"},
+		{name: "link", typ: tar.TypeSymlink, data: "/etc/passwd"},
+		{name: "sub/run.sh", typ: tar.TypeSymlink, data: "a.sh"},
+	})
+	var result TarPushResult
+	require.NoError(t, trans.unpackTar(user, buf, &result))
+	require.Equal(t, TarPushResult{Files: 2, Dirs: 1, Bytes: 7, Skipped: 1}, result)
+	target, err := os.Readlink(filepath.Join(home, "tom", "sub", "run.sh"))
+	require.NoError(t, err)
+	require.Equal(t, "a.sh", target)
+
+	info, err := os.Stat(filepath.Join(home, "tom", "sub", "a.sh"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0700), info.Mode().Perm())
+	_, err = os.Lstat(filepath.Join(home, "tom", "link"))
+	require.True(t, os.IsNotExist(err))
+	require.Equal(t, EventType(EventUpdate), trans.events[filepath.Join("tom", "sub", "a.sh")].Type)
+
+	// names escaping the user root stop the unpack
+	buf = buildTestTar(t, []testTarEntry{
+		{name: "../evil.txt", mode: 0644, typ: tar.TypeReg, data: "x"},
+	})
+	err = trans.unpackTar(user, buf, &result)
+	var pe *PathDeniedError
+	require.ErrorAs(t, err, &pe)
+	_, err = os.Stat(filepath.Join(home, "evil.txt"))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestTrans_handleTarPush(t *testing.T) {
+	home := t.TempDir()
+	trans := newTestTrans(home)
+	trans.auth = newServerAuth()
+	trans.server.conf.users = []*ServerConfUser{{Name: "tom", Root: "tom", Perms: []string{permWrite}, key: authKey("token")}}
+	require.NoError(t, os.Mkdir(filepath.Join(home, "tom"), 0755))
+	call := func(method string, args any, reply any) error {
+		switch method {
+		case "Trans.Hello":
+			*reply.(**AuthChallenge) = trans.auth.challenge()
+		case "Trans.Login":
+			_, s, err := trans.auth.login(trans.server.conf.users, args.(*AuthLogin))
+			if err != nil {
+				return err
+			}
+			*reply.(**AuthSession) = s
+		}
+		return nil
+	}
+	var ca clientAuth
+	require.NoError(t, ca.login("token", call))
+
+	push := func(name string, sign func(body []byte, arg *RpcArgs) string) int {
+		body := buildTestTar(t, []testTarEntry{{name: name, mode: 0644, typ: tar.TypeReg, data: "x"}}).Bytes()
+		arg := &RpcArgs{FileName: tarPushPath}
+		ca.sign(tarPushMethod, arg)
+		req := httptest.NewRequest(http.MethodPost, tarPushPath, bytes.NewReader(body))
+		req.Header.Set(headerSession, arg.Session)
+		req.Header.Set(headerTime, strconv.FormatInt(arg.Time, 10))
+		req.Header.Set(headerSeq, strconv.FormatUint(arg.Seq, 10))
+		req.Header.Set(headerSign, arg.Sign)
+		req.Trailer = http.Header{headerBodySign: {sign(body, arg)}}
+		rec := httptest.NewRecorder()
+		trans.handleTarPush(rec, req)
+		return rec.Code
+	}
+	bodySign := func(body []byte, arg *RpcArgs) string {
+		mac := ca.bodyMac(arg)
+		mac.Write(body)
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+	require.Equal(t, http.StatusOK, push("a.txt", bodySign))
+	require.FileExists(t, filepath.Join(home, "tom", "a.txt"))
+
+	// a body changed after it is signed is not written
+	require.Equal(t, http.StatusForbidden, push("b.txt", func(body []byte, arg *RpcArgs) string {
+		return bodySign(append(body, 0), arg)
+	}))
+	require.Equal(t, http.StatusForbidden, push("c.txt", func([]byte, *RpcArgs) string {
+		return ""
+	}))
+	require.NoFileExists(t, filepath.Join(home, "tom", "b.txt"))
+	require.NoFileExists(t, filepath.Join(home, "tom", "c.txt"))
+	spooled, err := filepath.Glob(filepath.Join(trans.server.conf.StateDir, "tarpush-*"))
+	require.NoError(t, err)
+	require.Empty(t, spooled)
+}
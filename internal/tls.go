@@ -0,0 +1,243 @@
+package internal
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// ServerConfTLS tls options of the hsyncd listener
+type ServerConfTLS struct {
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+
+	// Auto generate a self-signed pair next to the config file when certFile is empty
+	Auto bool `json:"auto"`
+
+	// ClientCA enables mutual tls, client certificates must be signed by it
+	ClientCA string `json:"clientCA"`
+
+	// AllowClients the CommonName or DNS names of client certificates allowed to connect,
+	// empty means any certificate signed by ClientCA
+	AllowClients []string `json:"allowClients"`
+}
+
+func (tc *ServerConfTLS) parse(confDir string) {
+	if tc.Auto && tc.CertFile == "" && tc.KeyFile == "" {
+		tc.CertFile = "hsyncd.crt"
+		tc.KeyFile = "hsyncd.key"
+	}
+	tc.CertFile = confPath(confDir, tc.CertFile)
+	tc.KeyFile = confPath(confDir, tc.KeyFile)
+	tc.ClientCA = confPath(confDir, tc.ClientCA)
+}
+
+func (tc *ServerConfTLS) isMutual() bool {
+	return tc != nil && tc.ClientCA != ""
+}
+
+func (tc *ServerConfTLS) tlsConfig() (*tls.Config, error) {
+	if tc.Auto {
+		if err := autoGenCert(tc.CertFile, tc.KeyFile); err != nil {
+			return nil, fmt.Errorf("generate self-signed cert: %w", err)
+		}
+	}
+	cert, err := tls.LoadX509KeyPair(tc.CertFile, tc.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	glog.Infoln("tls cert fingerprint:", certFingerprint(cert.Certificate[0]))
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if !tc.isMutual() {
+		return cfg, nil
+	}
+	pool, err := loadCertPool(tc.ClientCA)
+	if err != nil {
+		return nil, err
+	}
+	cfg.ClientCAs = pool
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	if len(tc.AllowClients) > 0 {
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("no client certificate")
+			}
+			leaf := cs.PeerCertificates[0]
+			if slices.Contains(tc.AllowClients, leaf.Subject.CommonName) {
+				return nil
+			}
+			for _, name := range leaf.DNSNames {
+				if slices.Contains(tc.AllowClients, name) {
+					return nil
+				}
+			}
+			glog.Warningln("tls client", leaf.Subject.CommonName, "not allowed")
+			return fmt.Errorf("client certificate %q not allowed", leaf.Subject.CommonName)
+		}
+	}
+	return cfg, nil
+}
+
+// ClientConfTLS tls options used to dial one server host
+type ClientConfTLS struct {
+	// CAFile verify the server certificate with it instead of the system roots
+	CAFile string `json:"caFile"`
+
+	// Fingerprint sha256 of the server certificate, the certificate is pinned
+	// and the chain is not verified
+	Fingerprint string `json:"fingerprint"`
+
+	InsecureSkipVerify bool   `json:"insecureSkipVerify"`
+	ServerName         string `json:"serverName"`
+
+	// CertFile and KeyFile the client certificate for mutual tls
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+}
+
+func (tc *ClientConfTLS) parse(confDir string) {
+	tc.CAFile = confPath(confDir, tc.CAFile)
+	tc.CertFile = confPath(confDir, tc.CertFile)
+	tc.KeyFile = confPath(confDir, tc.KeyFile)
+	tc.Fingerprint = normalizeFingerprint(tc.Fingerprint)
+}
+
+func (tc *ClientConfTLS) tlsConfig(host string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:         tc.ServerName,
+		InsecureSkipVerify: tc.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if cfg.ServerName == "" {
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			cfg.ServerName = h
+		}
+	}
+	if tc.CAFile != "" {
+		pool, err := loadCertPool(tc.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+	if tc.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(tc.CertFile, tc.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if tc.Fingerprint != "" {
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("no server certificate")
+			}
+			got := certFingerprint(rawCerts[0])
+			if got != tc.Fingerprint {
+				return fmt.Errorf("server certificate fingerprint %s not match", got)
+			}
+			return nil
+		}
+	}
+	return cfg, nil
+}
+
+func confPath(confDir string, name string) string {
+	name = strings.TrimSpace(strings.ReplaceAll(name, "{pwd}", confDir))
+	if name == "" || filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(confDir, name)
+}
+
+func loadCertPool(name string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificate found in %q", name)
+	}
+	return pool, nil
+}
+
+func certFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+func normalizeFingerprint(fp string) string {
+	fp = strings.ToLower(strings.TrimSpace(fp))
+	return strings.ReplaceAll(fp, ":", "")
+}
+
+// autoGenCert creates a self-signed certificate when certFile not exists
+func autoGenCert(certFile string, keyFile string) error {
+	if _, err := os.Stat(certFile); err == nil {
+		return nil
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	hostName, _ := os.Hostname()
+	tpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hostName, Organization: []string{"hsync"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if hostName != "" {
+		tpl.DNSNames = append(tpl.DNSNames, hostName)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err != nil {
+		return err
+	}
+	glog.Infoln("generated self-signed cert", certFile)
+	return nil
+}
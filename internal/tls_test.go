@@ -0,0 +1,51 @@
+package internal
+
+import (
+	"crypto/tls"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientConfTLS_fingerprint(t *testing.T) {
+	dir := t.TempDir()
+	stc := &ServerConfTLS{Auto: true}
+	stc.parse(dir)
+	require.Equal(t, filepath.Join(dir, "hsyncd.crt"), stc.CertFile)
+
+	serverConf, err := stc.tlsConfig()
+	require.NoError(t, err)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", serverConf)
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	dial := func(ctc *ClientConfTLS) error {
+		cfg, err := ctc.tlsConfig(l.Addr().String())
+		require.NoError(t, err)
+		conn, err := tls.Dial("tcp", l.Addr().String(), cfg)
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+
+	fp := certFingerprint(serverConf.Certificates[0].Certificate[0])
+	require.NoError(t, dial(&ClientConfTLS{Fingerprint: fp}))
+	require.Error(t, dial(&ClientConfTLS{Fingerprint: "00" + fp[2:]}))
+	require.Error(t, dial(&ClientConfTLS{}))
+
+	host, _, _ := net.SplitHostPort(l.Addr().String())
+	require.NoError(t, dial(&ClientConfTLS{CAFile: stc.CertFile, ServerName: host}))
+}
@@ -10,6 +10,7 @@ import (
 	"math"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
@@ -19,8 +20,13 @@ import (
 type transStats struct {
 	success map[string]int64
 	fail    map[string]int64
+	denied  map[string]int64
 	last    map[string]string
+	blob    map[string]int64
 	mux     sync.Mutex
+
+	// deploy the last results of deployCmd by deploy
+	deploy map[string][]*deployResult
 }
 
 func (ts *transStats) addWithArgs(name string, arg *RpcArgs, err error) {
@@ -40,16 +46,49 @@ func (ts *transStats) add(name string, msg string, err error) {
 		return
 	}
 	ts.fail[name]++
+	var pe *PathDeniedError
+	if errors.As(err, &pe) {
+		ts.denied[name]++
+	}
 	ts.last[name] = "fail: " + time.Now().Format(time.DateTime) + " " + msg + ", " + err.Error()
 }
 
+// addDeployResult keeps res as one of the last keep results of the deploy key
+func (ts *transStats) addDeployResult(key string, res *deployResult, keep int) {
+	var err error
+	if res.Err != "" {
+		err = errors.New(res.Err)
+	}
+	ts.add("DeployCmd", res.Event+" "+res.Dst, err)
+	ts.mux.Lock()
+	defer ts.mux.Unlock()
+	if ts.deploy == nil {
+		ts.deploy = make(map[string][]*deployResult)
+	}
+	results := append(ts.deploy[key], res)
+	if len(results) > keep {
+		results = results[len(results)-keep:]
+	}
+	ts.deploy[key] = results
+}
+
+// addBlob counts the result of a Trans.CopyByHash: hit_cache, hit_file or miss
+func (ts *transStats) addBlob(key string) {
+	ts.mux.Lock()
+	defer ts.mux.Unlock()
+	ts.blob[key]++
+}
+
 func (ts *transStats) String() string {
 	ts.mux.Lock()
 	defer ts.mux.Unlock()
 	data := map[string]any{
 		"Success": ts.success,
 		"Fail":    ts.fail,
+		"Denied":  ts.denied,
 		"Last":    ts.last,
+		"Blob":    ts.blob,
+		"Deploy":  ts.deploy,
 	}
 	bf, err := json.MarshalIndent(data, " ", "  ")
 	if err != nil {
@@ -59,23 +98,50 @@ func (ts *transStats) String() string {
 }
 
 type Trans struct {
-	events map[string]EventType
-	mu     sync.RWMutex
-	server *HSyncServer
-	stats  *transStats
+	events   map[string]*deployEvent
+	eventSeq uint64
+
+	// firstEvent the time of the oldest pending event, lastActive the time
+	// of the last event or chunk received, they decide when to deploy
+	firstEvent time.Time
+	lastActive time.Time
+	flush      chan struct{}
+
+	mu      sync.RWMutex
+	server  *HSyncServer
+	stats   *transStats
+	auth    *serverAuth
+	uploads *uploadStore
+	index   *hashIndex
+	blobs   *blobStore
 }
 
 func NewTrans(server *HSyncServer) *Trans {
 	trans := &Trans{
-		server: server,
-		events: make(map[string]EventType),
+		server:  server,
+		events:  make(map[string]*deployEvent),
+		flush:   make(chan struct{}, 1),
+		auth:    newServerAuth(),
+		uploads: newUploadStore(filepath.Join(server.conf.StateDir, "uploads"), time.Duration(server.conf.UploadTimeout)*time.Second),
+		index:   openHashIndex(filepath.Join(server.conf.StateDir, hashIndexFileName)),
 		stats: &transStats{
 			success: map[string]int64{},
 			fail:    map[string]int64{},
+			denied:  map[string]int64{},
 			last:    map[string]string{},
+			blob:    map[string]int64{},
 		},
 	}
+	if size := server.conf.BlobCacheSize; size > 0 {
+		trans.blobs = newBlobStore(filepath.Join(server.conf.StateDir, "blobs"), int64(size)<<20)
+	} else {
+		trans.blobs = newBlobStore("", 0)
+	}
 	go trans.eventLoop()
+	go trans.uploads.gcLoop()
+	go trans.index.saveLoop()
+	go trans.blobs.gcLoop()
+	go cleanStaleUploads(server.conf.Home, trans.uploads.timeout)
 	return trans
 }
 
@@ -85,24 +151,72 @@ type FileStat struct {
 	Md5      string
 	FileMode os.FileMode
 	Exists   bool
+
+	// Link the target of a symlink
+	Link string
+
+	// Sample the hash of the first and last blocks, only for the quick+sample comparison
+	Sample string
 }
 
 type RpcArgs struct {
-	Token    string
+	Session  string
+	Time     int64 // unix nano
+	Seq      uint64
+	Sign     string
 	FileName string
 	MyFile   *MyFile
-}
 
-type FileStatPart struct {
-	Start int64  `json:"start"`
-	Len   int64  `json:"len"`
-	Md5   string `json:"md5"`
+	// Delta the ops of Trans.ApplyDelta
+	Delta []*DeltaOp
+
+	// Manifest the gzipped entries of Trans.Manifest
+	Manifest []byte
+
+	// Batch the ops of Trans.Batch
+	Batch []*BatchOp
+
+	// Compare the comparison strategy of Trans.FileStat and Trans.Manifest, default is checksum
+	Compare string
 }
 
 func (stat *FileStat) IsDir() bool {
 	return stat.FileMode.IsDir() // && stat.FileMode&os.ModeSymlink != 1
 }
 
+// metaDiffer reports whether the mode or mtime of stat and other differ,
+// the mtime of dirs changes with their children and is not compared.
+// mtime is compared in seconds as some file systems do not keep more.
+func (stat *FileStat) metaDiffer(other *FileStat) bool {
+	if stat.IsLink() || other.IsLink() {
+		return false
+	}
+	if stat.FileMode.Perm() != other.FileMode.Perm() {
+		return true
+	}
+	return !stat.IsDir() && stat.Mtime.Unix() != other.Mtime.Unix()
+}
+
+// applyFileMeta sets the mode and mtime of stat to name, links are not changed
+func applyFileMeta(name string, stat *FileStat) error {
+	info, err := os.Lstat(name)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+	if info.Mode().Perm() != stat.FileMode.Perm() {
+		if err = os.Chmod(name, stat.FileMode.Perm()); err != nil {
+			return err
+		}
+	}
+	if !info.IsDir() && !stat.Mtime.IsZero() && !info.ModTime().Equal(stat.Mtime) {
+		return os.Chtimes(name, stat.Mtime, stat.Mtime)
+	}
+	return nil
+}
+
 type MyFile struct {
 	Name  string
 	Data  []byte
@@ -111,44 +225,123 @@ type MyFile struct {
 	Total int64
 	Index int64
 	Pos   int64
+
+	// UploadID the session from Trans.BeginUpload, empty for a plain CopyFile
+	UploadID string
+
+	// Md5 of the raw chunk data, before gzip
+	Md5 string
+}
+
+// ChecksumError the received data is not same as the client sent
+type ChecksumError struct {
+	Name string
+	Want string
+	Got  string
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("%s: %q, want=%s, got=%s", errChecksumMismatch, e.Name, e.Want, e.Got)
+}
+
+// errChecksumMismatch is matched by message on the client side
+const errChecksumMismatch = "checksum mismatch"
+
+func isChecksumMismatch(err error) bool {
+	return err != nil && strings.Contains(err.Error(), errChecksumMismatch)
+}
+
+// rawData decodes Data and verifies it with Md5
+func (f *MyFile) rawData() ([]byte, error) {
+	data := f.Data
+	if f.Gzip {
+		var err error
+		if data, err = dataGzipDecode(f.Data); err != nil {
+			return nil, &ChecksumError{Name: f.Name, Want: f.Md5, Got: err.Error()}
+		}
+	}
+	if f.Md5 != "" {
+		if got := ByteMd5(data); got != f.Md5 {
+			return nil, &ChecksumError{Name: fmt.Sprintf("%s[%d]", f.Name, f.Index), Want: f.Md5, Got: got}
+		}
+	}
+	return data, nil
 }
 
 func (f *MyFile) ToString() string {
 	return fmt.Sprintf("Name:%s,Mode:%v,Size:%d", f.Name, f.Stat.FileMode, f.Stat.Size)
 }
 
-func (trans *Trans) addEvent(relName string, et EventType) {
+// addEvent queues relName for deploy when the user is allowed to
+func (trans *Trans) addEvent(user *ServerConfUser, relName string, et EventType) {
+	if !user.can(permDeploy) {
+		glog.V(2).Infoln("user", user.Name, "has no deploy perm, skip event", relName)
+		return
+	}
 	trans.mu.Lock()
 	defer trans.mu.Unlock()
-	trans.events[relName] = et
+	trans.putEvent(relName, &deployEvent{Type: et, User: user.Name})
 }
 
 func (trans *Trans) Stats() string {
 	return trans.stats.String()
 }
 
-func (trans *Trans) cleanFileName(fileName string) (absPath string, relName string, err error) {
-	if filepath.IsAbs(fileName) {
-		absPath = filepath.Clean(fileName)
-	} else {
-		absPath, err = filepath.Abs(filepath.Join(trans.server.conf.Home, fileName))
+// cleanFileName resolves the file name sent by client inside the root of user,
+// names escaping it are rejected with a *PathDeniedError.
+// relName is relative to the server home.
+func (trans *Trans) cleanFileName(user *ServerConfUser, fileName string) (absPath string, relName string, err error) {
+	home := trans.server.conf.Home
+	absPath, _, err = secureJoin(filepath.Join(home, user.Root), fileName)
+	if err == nil && (isUploadTmp(absPath) || isSubPath(trans.server.conf.StateDir, absPath)) {
+		err = &PathDeniedError{Name: fileName, Reason: "reserved name"}
 	}
 	if err != nil {
-		return
+		glog.Warningln("trans.cleanFileName", user.Name, fileName, "failed:", err)
+		return "", "", err
 	}
-	relName, err = filepath.Rel(trans.server.conf.Home, absPath)
-	return
+	relName, err = filepath.Rel(home, absPath)
+	return absPath, relName, err
 }
 
-func (trans *Trans) checkToken(arg *RpcArgs) error {
-	if trans.server.conf.Token != arg.Token {
-		glog.Warningln("token not match")
-		return errors.New("token not match")
+// checkToken verifies the session of the call of method with arg and returns the user when it has perm
+func (trans *Trans) checkToken(method string, arg *RpcArgs, perm string) (*ServerConfUser, error) {
+	user, err := trans.auth.verify(method, arg)
+	if err != nil {
+		glog.Warningln("auth failed:", err)
+		return nil, err
+	}
+	if !user.can(perm) {
+		glog.Warningln("user", user.Name, "has no", perm, "perm")
+		return nil, fmt.Errorf("user %q has no %s permission", user.Name, perm)
 	}
 	arg.FileName = filepath.Clean(arg.FileName)
 	if arg.MyFile != nil && arg.MyFile.Name != "" {
 		arg.MyFile.Name = filepath.Clean(arg.MyFile.Name)
 	}
+	return user, nil
+}
+
+// Hello starts the login handshake, the client must answer the nonce with Login
+func (trans *Trans) Hello(clientVersion string, result *AuthChallenge) (err error) {
+	defer func() {
+		trans.stats.add("Hello", "client:"+clientVersion, err)
+	}()
+	*result = *trans.auth.challenge()
+	return nil
+}
+
+func (trans *Trans) Login(arg *AuthLogin, result *AuthSession) (err error) {
+	defer func() {
+		trans.stats.add("Login", "", err)
+	}()
+	user, session, err := trans.auth.login(trans.server.conf.users, arg)
+	if err != nil {
+		glog.Warningln("trans.Login failed:", err)
+		return err
+	}
+	glog.Infoln("trans.Login success, user:", user.Name)
+	*result = *session
 	return nil
 }
 
@@ -156,15 +349,16 @@ func (trans *Trans) FileStat(arg *RpcArgs, result *FileStat) (err error) {
 	defer func() {
 		trans.stats.addWithArgs("FileStat", arg, err)
 	}()
-	if err = trans.checkToken(arg); err != nil {
+	user, err := trans.checkToken("Trans.FileStat", arg, permRead)
+	if err != nil {
 		return err
 	}
 	glog.Infoln("trans.FileStat", arg.FileName)
-	fullName, _, err := trans.cleanFileName(arg.FileName)
+	fullName, _, err := trans.cleanFileName(user, arg.FileName)
 	if err != nil {
 		return err
 	}
-	err = fileGetStat(fullName, result, true)
+	err = trans.index.fileGetStatCompare(fullName, result, arg.Compare)
 	return err
 }
 
@@ -172,37 +366,46 @@ func (trans *Trans) FileReName(arg *RpcArgs, result *int) (err error) {
 	defer func() {
 		trans.stats.addWithArgs("FileReName", arg, err)
 	}()
-	if err = trans.checkToken(arg); err != nil {
+	user, err := trans.checkToken("Trans.FileReName", arg, permWrite)
+	if err != nil {
 		return err
 	}
 	glog.Infoln("trans.FileReName", arg.MyFile.Name, "->", arg.FileName)
-	fullName, relName, err := trans.cleanFileName(arg.FileName)
+	if err = trans.renameFile(user, arg.MyFile.Name, arg.FileName); err == nil {
+		*result = 1
+	}
+	return err
+}
+
+// renameFile moves fileNameOld to fileName inside the root of user
+func (trans *Trans) renameFile(user *ServerConfUser, fileNameOld string, fileName string) error {
+	fullName, relName, err := trans.cleanFileName(user, fileName)
 	if err != nil {
 		return err
 	}
-	fullNameOld, relNameOld, err := trans.cleanFileName(arg.MyFile.Name)
+	fullNameOld, relNameOld, err := trans.cleanFileName(user, fileNameOld)
 	if err != nil {
 		return err
 	}
-	err = os.Rename(fullNameOld, fullName)
-	if err == nil {
-		trans.addEvent(relName, EventUpdate)
-		trans.addEvent(relNameOld, EventDelete)
-		*result = 1
+	if err = os.Rename(fullNameOld, fullName); err != nil {
+		return err
 	}
-	return err
+	trans.addRenameEvent(user, relName, relNameOld)
+	return nil
 }
 
 func (trans *Trans) CopyFile(arg *RpcArgs, result *int) (err error) {
 	defer func() {
 		trans.stats.addWithArgs("CopyFile", arg, err)
 	}()
-	if err = trans.checkToken(arg); err != nil {
+	user, err := trans.checkToken("Trans.CopyFile", arg, permWrite)
+	if err != nil {
 		return err
 	}
+	trans.touchEvents()
 	myFile := arg.MyFile
 	// 	glog.Infoln("Call CopyFile ", myFile.ToString())
-	fullName, relName, err := trans.cleanFileName(arg.FileName)
+	fullName, relName, err := trans.cleanFileName(user, arg.FileName)
 
 	defer func() {
 		if err == nil {
@@ -213,50 +416,36 @@ func (trans *Trans) CopyFile(arg *RpcArgs, result *int) (err error) {
 	}()
 
 	if err != nil {
-		return fmt.Errorf("trans.CopyFile wrong file name,err:%s", err.Error())
+		return fmt.Errorf("trans.CopyFile wrong file name,err:%w", err)
 	}
 	if myFile.Stat.IsDir() {
-		err = checkDir(fullName, myFile.Stat.FileMode)
-	} else {
-		err = checkDir(filepath.Dir(fullName), 0755)
-		var data []byte
-		if myFile.Gzip {
-			data = dataGzipDecode(myFile.Data)
-		} else {
-			data = myFile.Data
+		if err = checkDir(fullName, myFile.Stat.FileMode); err == nil {
+			err = applyFileMeta(fullName, myFile.Stat)
 		}
-		info, err := os.Stat(fullName)
-		if err != nil {
-			if !os.IsNotExist(err) {
-				return err
-			}
+	} else if myFile.Stat.IsLink() {
+		if err = trans.makeSymlink(user, fullName, myFile.Stat.Link); err == nil {
+			trans.addEvent(user, relName, EventUpdate)
 		}
-		if !myFile.Stat.IsDir() && info != nil && info.IsDir() {
-			err = os.RemoveAll(fullName)
-			glog.Infoln("trans.CopyFile | removeAll (%s) exists and not dir,because source is dir,err=", err)
-			if err != nil {
-				return err
-			}
-		}
-		var f *os.File
-		f, err = os.OpenFile(fullName, os.O_RDWR|os.O_CREATE, myFile.Stat.FileMode)
-		if err != nil {
-			return err
-		}
-		defer f.Close()
-		n, err := f.WriteAt(data, myFile.Pos)
-		if err != nil {
+	} else {
+		var data []byte
+		if data, err = myFile.rawData(); err != nil {
 			return err
 		}
-		if n != len(data) {
-			return fmt.Errorf("trans.CopyFile part of the data wrote failed,expect len=%d,now len=%d", len(data), n)
-		}
-		if myFile.Total == 0 || myFile.Index+1 == myFile.Total {
-			err = f.Truncate(myFile.Stat.Size)
-			if err != nil {
-				return err
+		if myFile.UploadID != "" {
+			var uf *uploadFile
+			if uf, err = trans.uploads.lookup(myFile.UploadID); err == nil {
+				if uf.Target != fullName {
+					return fmt.Errorf("upload %q is not for %q", uf.ID, relName)
+				}
+				err = trans.uploads.write(uf, myFile, data)
+			}
+		} else {
+			var done bool
+			done, err = trans.uploads.writeChunk(fullName, myFile, data)
+			if done {
+				trans.blobs.add(user.Name, fullName, myFile.Stat.Md5)
+				trans.addEvent(user, relName, EventUpdate)
 			}
-			trans.addEvent(relName, EventUpdate)
 		}
 	}
 	if err != nil {
@@ -266,6 +455,211 @@ func (trans *Trans) CopyFile(arg *RpcArgs, result *int) (err error) {
 	return err
 }
 
+// FileMeta sets the mode and mtime of arg.FileName to arg.MyFile.Stat without
+// sending the content
+func (trans *Trans) FileMeta(arg *RpcArgs, result *int) (err error) {
+	defer func() {
+		trans.stats.addWithArgs("FileMeta", arg, err)
+	}()
+	user, err := trans.checkToken("Trans.FileMeta", arg, permWrite)
+	if err != nil {
+		return err
+	}
+	fullName, relName, err := trans.cleanFileName(user, arg.FileName)
+	if err != nil {
+		return err
+	}
+	if arg.MyFile == nil || arg.MyFile.Stat == nil {
+		return errors.New("miss file stat")
+	}
+	if err = applyFileMeta(fullName, arg.MyFile.Stat); err != nil {
+		return err
+	}
+	glog.Infof("trans.FileMeta [%s] mode=%v mtime=%s", relName, arg.MyFile.Stat.FileMode.Perm(), arg.MyFile.Stat.Mtime.Format(time.DateTime))
+	trans.addEvent(user, relName, EventUpdate)
+	*result = 1
+	return nil
+}
+
+// BeginUpload starts or resumes the chunked upload of arg.FileName,
+// arg.MyFile carries the stat of the whole file and the chunk total
+func (trans *Trans) BeginUpload(arg *RpcArgs, result *UploadSession) (err error) {
+	defer func() {
+		trans.stats.addWithArgs("BeginUpload", arg, err)
+	}()
+	user, err := trans.checkToken("Trans.BeginUpload", arg, permWrite)
+	if err != nil {
+		return err
+	}
+	trans.touchEvents()
+	fullName, relName, err := trans.cleanFileName(user, arg.FileName)
+	if err != nil {
+		return err
+	}
+	if arg.MyFile == nil || arg.MyFile.Stat == nil {
+		return errors.New("miss file stat")
+	}
+	id := uploadID(user.Name, relName, arg.MyFile.Stat)
+	uf, err := trans.uploads.begin(id, fullName, false)
+	if err != nil {
+		return err
+	}
+	uf.mu.Lock()
+	defer uf.mu.Unlock()
+	result.ID = uf.ID
+	result.Have = uf.haveList()
+	glog.Infof("trans.BeginUpload [%s] id=%s have %d/%d", relName, id, len(result.Have), arg.MyFile.Total)
+	return nil
+}
+
+// CommitUpload replaces arg.FileName with the chunks of session arg.MyFile.UploadID
+func (trans *Trans) CommitUpload(arg *RpcArgs, result *int) (err error) {
+	defer func() {
+		trans.stats.addWithArgs("CommitUpload", arg, err)
+	}()
+	user, err := trans.checkToken("Trans.CommitUpload", arg, permWrite)
+	if err != nil {
+		return err
+	}
+	fullName, relName, err := trans.cleanFileName(user, arg.FileName)
+	if err != nil {
+		return err
+	}
+	if arg.MyFile == nil || arg.MyFile.Stat == nil {
+		return errors.New("miss file stat")
+	}
+	uf, err := trans.uploads.lookup(arg.MyFile.UploadID)
+	if err != nil {
+		return err
+	}
+	if uf.Target != fullName {
+		return fmt.Errorf("upload %q is not for %q", uf.ID, relName)
+	}
+	if err = trans.uploads.commit(uf, arg.MyFile.Stat); err != nil {
+		return err
+	}
+	glog.Infof("trans.CommitUpload [%s] id=%s suc", relName, uf.ID)
+	trans.blobs.add(user.Name, fullName, arg.MyFile.Stat.Md5)
+	trans.addEvent(user, relName, EventUpdate)
+	*result = 1
+	return nil
+}
+
+// CopyByHash creates arg.FileName from the content with md5 arg.MyFile.Stat.Md5
+// the server already has, result is 0 when there is none and the client must send the data
+func (trans *Trans) CopyByHash(arg *RpcArgs, result *int) (err error) {
+	defer func() {
+		trans.stats.addWithArgs("CopyByHash", arg, err)
+	}()
+	user, err := trans.checkToken("Trans.CopyByHash", arg, permWrite)
+	if err != nil {
+		return err
+	}
+	fullName, relName, err := trans.cleanFileName(user, arg.FileName)
+	if err != nil {
+		return err
+	}
+	if arg.MyFile == nil || arg.MyFile.Stat == nil {
+		return errors.New("miss file stat")
+	}
+	stat := arg.MyFile.Stat
+	if !isMd5Hex(stat.Md5) {
+		return fmt.Errorf("invalid md5 %q", stat.Md5)
+	}
+	from, err := trans.copyByHash(user, fullName, stat)
+	if err != nil {
+		return err
+	}
+	if from == "" {
+		trans.stats.addBlob("miss")
+		glog.Infof("trans.CopyByHash [%s] md5=%s miss", relName, stat.Md5)
+		return nil
+	}
+	if from == "cache" {
+		trans.stats.addBlob("hit_cache")
+	} else {
+		trans.stats.addBlob("hit_file")
+	}
+	glog.Infof("trans.CopyByHash [%s] md5=%s from %s suc", relName, stat.Md5, from)
+	trans.addEvent(user, relName, EventUpdate)
+	*result = 1
+	return nil
+}
+
+// FileSignature returns the block signatures of arg.FileName for a delta upload
+func (trans *Trans) FileSignature(arg *RpcArgs, result *FileSignature) (err error) {
+	defer func() {
+		trans.stats.addWithArgs("FileSignature", arg, err)
+	}()
+	user, err := trans.checkToken("Trans.FileSignature", arg, permRead)
+	if err != nil {
+		return err
+	}
+	fullName, _, err := trans.cleanFileName(user, arg.FileName)
+	if err != nil {
+		return err
+	}
+	return fileGetSignature(fullName, 0, result)
+}
+
+// ApplyDelta rebuilds arg.FileName from the current file and arg.Delta,
+// the output of the ops is written at arg.MyFile.Pos of an upload session
+// which is finished by CommitUpload. The first call starts the session.
+func (trans *Trans) ApplyDelta(arg *RpcArgs, result *UploadSession) (err error) {
+	defer func() {
+		trans.stats.addWithArgs("ApplyDelta", arg, err)
+	}()
+	user, err := trans.checkToken("Trans.ApplyDelta", arg, permWrite)
+	if err != nil {
+		return err
+	}
+	trans.touchEvents()
+	fullName, relName, err := trans.cleanFileName(user, arg.FileName)
+	if err != nil {
+		return err
+	}
+	if arg.MyFile == nil || arg.MyFile.Stat == nil {
+		return errors.New("miss file stat")
+	}
+	var uf *uploadFile
+	if arg.MyFile.UploadID == "" {
+		uf, err = trans.uploads.begin("delta-"+uploadID(user.Name, relName, arg.MyFile.Stat), fullName, true)
+	} else {
+		uf, err = trans.uploads.lookup(arg.MyFile.UploadID)
+	}
+	if err != nil {
+		return err
+	}
+	if uf.Target != fullName {
+		return fmt.Errorf("upload %q is not for %q", uf.ID, relName)
+	}
+	if err = trans.uploads.writeDelta(uf, arg.Delta, arg.MyFile.Pos); err != nil {
+		return err
+	}
+	glog.Infof("trans.ApplyDelta [%s] id=%s pos=%d ops=%d", relName, uf.ID, arg.MyFile.Pos, len(arg.Delta))
+	result.ID = uf.ID
+	return nil
+}
+
+// Manifest compares a batch of client entries with the server files
+// and returns the names which are missing or different
+func (trans *Trans) Manifest(arg *RpcArgs, result *ManifestResult) (err error) {
+	defer func() {
+		trans.stats.add("Manifest", fmt.Sprintf("%d differs", len(result.Differs)), err)
+	}()
+	user, err := trans.checkToken("Trans.Manifest", arg, permRead)
+	if err != nil {
+		return err
+	}
+	entries, err := decodeManifest(arg.Manifest)
+	if err != nil {
+		return err
+	}
+	trans.compareManifest(user, entries, arg.Compare, result)
+	glog.Infof("trans.Manifest %d entries, %d differs, %d failed", len(entries), len(result.Differs), len(result.Errs))
+	return nil
+}
+
 func (trans *Trans) Version(clientVersion string, v *string) (err error) {
 	defer func() {
 		trans.stats.add("Version", "client:"+clientVersion, err)
@@ -275,65 +669,90 @@ func (trans *Trans) Version(clientVersion string, v *string) (err error) {
 	return nil
 }
 
+// Flush tells the server the client finished sending a batch of changes,
+// the pending events are deployed without waiting for the settle window
+func (trans *Trans) Flush(arg *RpcArgs, result *int) (err error) {
+	defer func() {
+		trans.stats.addWithArgs("Flush", arg, err)
+	}()
+	if _, err = trans.checkToken("Trans.Flush", arg, permDeploy); err != nil {
+		return err
+	}
+	glog.V(2).Infoln("trans.Flush")
+	trans.flushEvents()
+	*result = 1
+	return nil
+}
+
 func (trans *Trans) DeleteFile(arg *RpcArgs, result *int) (err error) {
 	defer func() {
 		trans.stats.addWithArgs("DeleteFile", arg, err)
 	}()
 
-	if err = trans.checkToken(arg); err != nil {
+	user, err := trans.checkToken("Trans.DeleteFile", arg, permDelete)
+	if err != nil {
 		return err
 	}
-	if arg.FileName == "." {
-		glog.Infoln("trans.DeleteFile.ignored", arg.FileName)
-		return nil
+	if err = trans.removeFile(user, arg.FileName); err != nil {
+		return err
 	}
+	*result = 1
+	return nil
+}
 
-	fullName, relName, err := trans.cleanFileName(arg.FileName)
-	glog.Infoln("trans.DeleteFile", arg.FileName, fullName)
-
+// removeFile deletes fileName inside the root of user, the root itself is kept
+func (trans *Trans) removeFile(user *ServerConfUser, fileName string) error {
+	if filepath.Clean(fileName) == "." {
+		glog.Infoln("trans.DeleteFile.ignored", fileName)
+		return nil
+	}
+	fullName, relName, err := trans.cleanFileName(user, fileName)
+	glog.Infoln("trans.DeleteFile", fileName, fullName)
 	if err != nil {
 		return err
 	}
+	trans.stashBlobs(user, fullName)
 	err = os.RemoveAll(fullName)
 	if err != nil && !os.IsNotExist(err) {
 		return err
 	}
-	*result = 1
-	trans.addEvent(relName, EventDelete)
-	return err
-}
-
-type FileStatSlice struct {
-	Size  int64           `json:"size"`
-	Total int64           `json:"total"`
-	Parts []*FileStatPart `json:"parts"`
+	trans.addEvent(user, relName, EventDelete)
+	return nil
 }
 
-func (trans *Trans) FileStatSlice(arg *RpcArgs, result *FileStatSlice) (err error) {
+// Batch applies arg.Batch in order, the result of each op is in result.Results
+// at the same index, a failed op does not stop the ones after it
+func (trans *Trans) Batch(arg *RpcArgs, result *BatchResult) (err error) {
 	defer func() {
-		trans.stats.addWithArgs("FileStatSlice", arg, err)
+		trans.stats.add("Batch", fmt.Sprintf("%d ops, %d failed", len(arg.Batch), result.failed()), err)
 	}()
-	if err = trans.checkToken(arg); err != nil {
-		return err
-	}
-	glog.Infoln("trans.FileStatSlice", arg.FileName)
-	fullName, _, err := trans.cleanFileName(arg.FileName)
+	user, err := trans.checkToken("Trans.Batch", arg, permWrite)
 	if err != nil {
 		return err
 	}
-	err = fileGetStatSlice(fullName, result)
-	return err
+	result.Results = make([]*BatchOpResult, len(arg.Batch))
+	for i, op := range arg.Batch {
+		res := &BatchOpResult{Name: op.Name}
+		if errOp := trans.applyBatchOp(user, op); errOp != nil {
+			glog.Warningf("trans.Batch %s [%s] failed,err:%v", op.Op, op.Name, errOp)
+			res.Err = errOp.Error()
+		}
+		result.Results[i] = res
+	}
+	glog.Infof("trans.Batch %d ops, %d failed", len(arg.Batch), result.failed())
+	return nil
 }
 
 func (trans *Trans) FileTruncate(arg *RpcArgs, result *int64) (err error) {
 	defer func() {
 		trans.stats.addWithArgs("FileTruncate", arg, err)
 	}()
-	if err = trans.checkToken(arg); err != nil {
+	user, err := trans.checkToken("Trans.FileTruncate", arg, permWrite)
+	if err != nil {
 		return err
 	}
-	glog.Infoln("trans.FileStatSlice", arg.FileName)
-	fullName, _, err := trans.cleanFileName(arg.FileName)
+	glog.Infoln("trans.FileTruncate", arg.FileName)
+	fullName, _, err := trans.cleanFileName(user, arg.FileName)
 	if err != nil {
 		return err
 	}
@@ -362,25 +781,37 @@ func (trans *Trans) DirList(arg *RpcArgs, result *DirList) (err error) {
 	defer func() {
 		trans.stats.addWithArgs("DirList", arg, err)
 	}()
-	if err = trans.checkToken(arg); err != nil {
+	user, err := trans.checkToken("Trans.DirList", arg, permRead)
+	if err != nil {
 		return err
 	}
-	glog.Infoln("trans.FileStatSlice", arg.FileName)
-	fullName, _, err := trans.cleanFileName(arg.FileName)
+	glog.Infoln("trans.DirList", arg.FileName)
+	fullName, _, err := trans.cleanFileName(user, arg.FileName)
 	if err != nil {
 		return err
 	}
-	result = &DirList{}
+	root := filepath.Join(trans.server.conf.Home, user.Root)
 	err = filepath.WalkDir(fullName, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
+			if os.IsNotExist(err) && path == fullName {
+				return nil
+			}
 			return err
 		}
-
-		_, relName, err := trans.cleanFileName(path)
+		if path == fullName {
+			return nil
+		}
+		if isUploadTmp(path) || isSubPath(trans.server.conf.StateDir, path) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		relName, err := filepath.Rel(root, path)
 		if err != nil {
 			return err
 		}
-		result.Files = append(result.Files, relName)
+		result.Files = append(result.Files, filepath.ToSlash(relName))
 		if d.IsDir() {
 			return filepath.SkipDir
 		}
@@ -389,56 +820,64 @@ func (trans *Trans) DirList(arg *RpcArgs, result *DirList) (err error) {
 	return err
 }
 
-func (trans *Trans) copyEvents() map[string]EventType {
+func (trans *Trans) copyEvents() map[string]*deployEvent {
 	trans.mu.Lock()
 	defer trans.mu.Unlock()
 	cp := maps.Clone(trans.events)
 	clear(trans.events)
+	trans.firstEvent = time.Time{}
 	return cp
 }
 
+// eventLoop deploys the pending events once no event or chunk is received
+// for the settle window, the max wait passed, or a client asked by Trans.Flush
 func (trans *Trans) eventLoop() {
-	dealEvent := func(relName string, et EventType) {
-		deployTo := trans.server.conf.getDeployTo(relName)
-		glog.Infoln("trans.eventLoop deploy", relName, "-->", deployTo)
-		if len(deployTo) > 0 {
-			if et == EventUpdate {
-				for _, to := range deployTo {
-					trans.server.deploy(to, relName)
-				}
-			}
-			// else if et == EventDelete {
-			// 	do nothing
-			// }
-		}
-	}
 	eventHandler := func() {
 		events := trans.copyEvents()
-		fmt.Print(len(events))
 		glog.V(2).Info("trans.eventLoop event buffer length:", len(events))
 		if len(events) == 0 {
 			return
 		}
-		for fileName, v := range events {
-			dealEvent(fileName, v)
+		var done []*deployJob
+		for _, fileName := range sortedEvents(events) {
+			done = append(done, trans.server.dealEvent(fileName, events[fileName])...)
 		}
+		done = append(done, trans.server.deployReleases(events)...)
+		trans.server.runBatchDeployCmd(done)
 	}
 
-	tm := time.NewTimer(time.Second / 2)
-	defer tm.Stop()
+	settle := time.Duration(trans.server.conf.DeploySettle) * time.Millisecond
+	maxWait := time.Duration(trans.server.conf.DeployMaxWait) * time.Millisecond
+	tk := time.NewTicker(max(settle/5, 20*time.Millisecond))
+	defer tk.Stop()
 
-	for range tm.C {
-		eventHandler()
-		tm.Reset(time.Second)
+	for {
+		var force bool
+		select {
+		case <-tk.C:
+		case <-trans.flush:
+			force = true
+		}
+		if trans.eventsReady(time.Now(), settle, maxWait, force) {
+			eventHandler()
+		} else {
+			// the changes delayed by the releaseInterval of release deploys
+			trans.server.runBatchDeployCmd(trans.server.deployReleases(nil))
+		}
 	}
-
-	glog.Error("trans.eventLoop exit")
 }
 
 func fileGetStat(name string, stat *FileStat, md5 bool) error {
-	info, err := os.Stat(name)
+	return (*hashIndex)(nil).fileGetStat(name, stat, md5)
+}
+
+// fileGetStat gets the stat of name, the md5 is read from hi when the file not changed.
+// A symlink is reported as link unless hi follows links.
+func (hi *hashIndex) fileGetStat(name string, stat *FileStat, md5 bool) error {
+	info, err := hi.stat(name)
 	if err != nil {
 		if os.IsNotExist(err) {
+			hi.remove(name)
 			return nil
 		}
 		return err
@@ -447,22 +886,27 @@ func fileGetStat(name string, stat *FileStat, md5 bool) error {
 	stat.Mtime = info.ModTime()
 	stat.Size = info.Size()
 	stat.FileMode = info.Mode()
+	if stat.IsLink() {
+		stat.Size = 0
+		stat.Link, err = os.Readlink(name)
+		return err
+	}
 	if stat.Size > 0 && !stat.IsDir() && md5 && stat.FileMode&os.ModeNamedPipe == 0 {
-		stat.Md5 = FileMd5(name)
+		stat.Md5 = hi.fileMd5(name, info)
 	}
 	return nil
 }
 
 const TransMaxLength = 10485760 // 10Mb
 
-func fileGetMyFile(absPath string, index int64) (*MyFile, error) {
+func (hi *hashIndex) fileGetMyFile(absPath string, index int64) (*MyFile, error) {
 	stat := new(FileStat)
 	md5 := false
 	if index == 0 {
 		md5 = true
 	}
 
-	err := fileGetStat(absPath, stat, md5)
+	err := hi.fileGetStat(absPath, stat, md5)
 	if err != nil {
 		return nil, err
 	}
@@ -472,7 +916,7 @@ func fileGetMyFile(absPath string, index int64) (*MyFile, error) {
 		Gzip: false,
 		Pos:  TransMaxLength * index,
 	}
-	if !stat.IsDir() {
+	if !stat.IsDir() && !stat.IsLink() {
 		my, err := os.Open(absPath)
 		if err != nil {
 			return nil, err
@@ -487,6 +931,7 @@ func fileGetMyFile(absPath string, index int64) (*MyFile, error) {
 		}
 		f.Data = dataGzipEncode(data[:n])
 		f.Gzip = true
+		f.Md5 = ByteMd5(data[:n])
 	}
 	return f, nil
 }
@@ -503,44 +948,3 @@ func fileGetMyFileStat(absPath string) (*MyFile, error) {
 	}
 	return f, nil
 }
-
-func fileGetStatSlice(name string, statSlice *FileStatSlice) error {
-	info, err := os.Stat(name)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil
-		}
-		return err
-	}
-	if info.IsDir() {
-		return errors.New("not file")
-	}
-	my, err := os.Open(name)
-	if err != nil {
-		return err
-	}
-	defer my.Close()
-
-	statSlice.Size = info.Size()
-	statSlice.Total = int64(math.Max(math.Ceil(float64(statSlice.Size)/float64(TransMaxLength)), 1))
-	statSlice.Parts = make([]*FileStatPart, 0, statSlice.Total)
-	var index int64 = 0
-	var pos int64 = 0
-
-	buf := make([]byte, TransMaxLength)
-
-	for index < statSlice.Total {
-		n, err := my.ReadAt(buf, pos)
-		if err != nil && err != io.EOF {
-			return err
-		}
-		sp := new(FileStatPart)
-		sp.Start = index * TransMaxLength
-		sp.Len = int64(n)
-		pos = sp.Start + sp.Len
-		sp.Md5 = ByteMd5(buf[:n])
-		statSlice.Parts = append(statSlice.Parts, sp)
-		index++
-	}
-	return nil
-}
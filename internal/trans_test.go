@@ -1,17 +1,51 @@
 package internal
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
-func TestFileGetStatSlice(t *testing.T) {
-	var stat FileStatSlice
-	name := "./conf.go"
-	err := fileGetStatSlice(name, &stat)
-	if err != nil {
-		t.Error(err)
-	}
-	if stat.Total != 1 {
-		t.Error("part total wrong")
+func TestMyFile_rawData(t *testing.T) {
+	raw := []byte("hello world")
+	f := &MyFile{Name: "a.txt", Data: dataGzipEncode(raw), Gzip: true, Md5: ByteMd5(raw)}
+	got, err := f.rawData()
+	if err != nil || string(got) != string(raw) {
+		t.Fatal("rawData failed", err)
+	}
+
+	f.Md5 = ByteMd5([]byte("other"))
+	if _, err = f.rawData(); !isChecksumMismatch(err) {
+		t.Error("want checksum mismatch, got", err)
+	}
+
+	f.Data = f.Data[:len(f.Data)-4]
+	f.Md5 = ByteMd5(raw)
+	if _, err = f.rawData(); !isChecksumMismatch(err) {
+		t.Error("broken gzip data want checksum mismatch, got", err)
+	}
+}
+
+func TestApplyFileMeta(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "a.sh")
+	if err := os.WriteFile(name, []byte("echo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	want := &FileStat{FileMode: 0755, Mtime: mtime}
+	if err := applyFileMeta(name, want); err != nil {
+		t.Fatal(err)
+	}
+	var got FileStat
+	if err := fileGetStat(name, &got, false); err != nil {
+		t.Fatal(err)
+	}
+	if got.metaDiffer(want) {
+		t.Errorf("meta not applied, mode=%v mtime=%v", got.FileMode, got.Mtime)
+	}
+	want.Mtime = mtime.Add(time.Second)
+	if !got.metaDiffer(want) {
+		t.Error("want mtime differ")
 	}
 }
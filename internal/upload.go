@@ -0,0 +1,378 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// uploadTmpPrefix the prefix of staged upload files, names with it are reserved
+const uploadTmpPrefix = ".hsync-upload-"
+
+func isUploadTmp(name string) bool {
+	return strings.HasPrefix(filepath.Base(name), uploadTmpPrefix)
+}
+
+// UploadSession returned by Trans.BeginUpload, Have are the chunk indexes
+// the server already has
+type UploadSession struct {
+	ID   string
+	Have []int64
+}
+
+// uploadID is stable for the same content, so an upload interrupted by a
+// client restart resumes with the same session
+func uploadID(userName string, relName string, stat *FileStat) string {
+	return StrMd5(strings.Join([]string{userName, filepath.ToSlash(relName), strconv.FormatInt(stat.Size, 10), stat.Md5}, "|"))
+}
+
+// uploadFile a file being received, chunks are written into TmpName
+// which replaces Target only after commit
+type uploadFile struct {
+	ID      string
+	Target  string
+	TmpName string
+	Have    map[int64]bool
+	Updated time.Time
+
+	statePath string
+	mu        sync.Mutex
+}
+
+func (uf *uploadFile) writeAt(data []byte, pos int64) error {
+	f, err := os.OpenFile(uf.TmpName, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	n, err := f.WriteAt(data, pos)
+	if err != nil {
+		return err
+	}
+	if n != len(data) {
+		return fmt.Errorf("part of the data wrote failed,expect len=%d,now len=%d", len(data), n)
+	}
+	uf.Updated = time.Now()
+	return nil
+}
+
+func (uf *uploadFile) haveList() []int64 {
+	have := make([]int64, 0, len(uf.Have))
+	for index := range uf.Have {
+		have = append(have, index)
+	}
+	return have
+}
+
+func (uf *uploadFile) save() error {
+	if uf.statePath == "" {
+		return nil
+	}
+	data, err := json.Marshal(uf)
+	if err != nil {
+		return err
+	}
+	tmp := uf.statePath + ".tmp"
+	if err = os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, uf.statePath)
+}
+
+// commit syncs the staged file, verifies it with stat.Md5, applies the mode
+// and mtime of stat and renames it over Target
+func (uf *uploadFile) commit(stat *FileStat) error {
+	f, err := os.OpenFile(uf.TmpName, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	if err = f.Truncate(stat.Size); err == nil {
+		err = f.Sync()
+	}
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		return err
+	}
+	if stat.Md5 != "" {
+		if got := FileMd5(uf.TmpName); got != stat.Md5 {
+			return &ChecksumError{Name: uf.Target, Want: stat.Md5, Got: got}
+		}
+	}
+	if err = os.Chmod(uf.TmpName, stat.FileMode.Perm()); err != nil {
+		return err
+	}
+	if !stat.Mtime.IsZero() {
+		if err = os.Chtimes(uf.TmpName, stat.Mtime, stat.Mtime); err != nil {
+			return err
+		}
+	}
+	if info, err := os.Lstat(uf.Target); err == nil && info.IsDir() {
+		glog.Infof("upload target [%s] exists and is dir, removeAll", uf.Target)
+		if err = os.RemoveAll(uf.Target); err != nil {
+			return err
+		}
+	}
+	return os.Rename(uf.TmpName, uf.Target)
+}
+
+func (uf *uploadFile) abort() {
+	if err := os.Remove(uf.TmpName); err != nil && !os.IsNotExist(err) {
+		glog.Warningln("remove upload tmp file", uf.TmpName, "failed:", err)
+	}
+	uf.removeState()
+}
+
+func (uf *uploadFile) removeState() {
+	if uf.statePath == "" {
+		return
+	}
+	if err := os.Remove(uf.statePath); err != nil && !os.IsNotExist(err) {
+		glog.Warningln("remove upload state", uf.statePath, "failed:", err)
+	}
+}
+
+type uploadStore struct {
+	files    map[string]*uploadFile
+	stateDir string
+	timeout  time.Duration
+	mu       sync.Mutex
+}
+
+// newUploadStore loads the upload sessions saved in stateDir,
+// sessions are only kept in memory when stateDir is empty
+func newUploadStore(stateDir string, timeout time.Duration) *uploadStore {
+	us := &uploadStore{
+		files:    make(map[string]*uploadFile),
+		stateDir: stateDir,
+		timeout:  timeout,
+	}
+	if stateDir == "" {
+		return us
+	}
+	if err := checkDir(stateDir, 0700); err != nil {
+		glog.Warningln("create upload state dir failed:", err)
+		us.stateDir = ""
+		return us
+	}
+	names, _ := filepath.Glob(filepath.Join(stateDir, "*.json"))
+	for _, name := range names {
+		data, err := os.ReadFile(name)
+		uf := &uploadFile{}
+		if err == nil {
+			err = json.Unmarshal(data, uf)
+		}
+		if err != nil || uf.ID == "" {
+			glog.Warningln("load upload state", name, "failed, removed:", err)
+			os.Remove(name)
+			continue
+		}
+		uf.statePath = name
+		us.files[uf.ID] = uf
+	}
+	glog.Infoln("loaded", len(us.files), "upload sessions from", stateDir)
+	return us
+}
+
+func (us *uploadStore) lookup(id string) (*uploadFile, error) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	uf := us.files[id]
+	if uf == nil {
+		return nil, fmt.Errorf("upload %q not found", id)
+	}
+	return uf, nil
+}
+
+// begin returns the upload session id of target, an existing one is resumed
+func (us *uploadStore) begin(id string, target string, restart bool) (*uploadFile, error) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	uf := us.files[id]
+	if uf != nil && !restart && uf.Target == target {
+		if _, err := os.Stat(uf.TmpName); err == nil {
+			return uf, nil
+		}
+	}
+	if uf != nil {
+		uf.abort()
+		delete(us.files, id)
+	}
+	if err := checkDir(filepath.Dir(target), 0755); err != nil {
+		return nil, err
+	}
+	uf = &uploadFile{
+		ID:      id,
+		Target:  target,
+		TmpName: filepath.Join(filepath.Dir(target), uploadTmpPrefix+filepath.Base(target)+"-"+id[:12]),
+		Have:    make(map[int64]bool),
+		Updated: time.Now(),
+	}
+	if us.stateDir != "" {
+		uf.statePath = filepath.Join(us.stateDir, id+".json")
+	}
+	tmp, err := os.OpenFile(uf.TmpName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = tmp.Close()
+	if err == nil {
+		err = uf.save()
+	}
+	if err != nil {
+		uf.abort()
+		return nil, err
+	}
+	us.files[id] = uf
+	return uf, nil
+}
+
+// write stores one chunk of the session
+func (us *uploadStore) write(uf *uploadFile, myFile *MyFile, data []byte) error {
+	uf.mu.Lock()
+	defer uf.mu.Unlock()
+	if err := uf.writeAt(data, myFile.Pos); err != nil {
+		return err
+	}
+	uf.Have[myFile.Index] = true
+	return uf.save()
+}
+
+// writeDelta writes the output of ops at pos, copy ops read from the target
+func (us *uploadStore) writeDelta(uf *uploadFile, ops []*DeltaOp, pos int64) error {
+	uf.mu.Lock()
+	defer uf.mu.Unlock()
+	var base io.ReaderAt
+	var baseSize int64
+	if f, err := os.Open(uf.Target); err == nil {
+		defer f.Close()
+		if info, err := f.Stat(); err == nil && info.Mode().IsRegular() {
+			base, baseSize = f, info.Size()
+		}
+	}
+	tmp, err := os.OpenFile(uf.TmpName, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer tmp.Close()
+	if _, err = applyDelta(base, baseSize, ops, tmp, pos); err != nil {
+		return err
+	}
+	uf.Updated = time.Now()
+	return uf.save()
+}
+
+// commit replaces the target of the session and forgets it
+func (us *uploadStore) commit(uf *uploadFile, stat *FileStat) error {
+	uf.mu.Lock()
+	defer uf.mu.Unlock()
+
+	us.mu.Lock()
+	if us.files[uf.ID] == uf {
+		delete(us.files, uf.ID)
+	}
+	us.mu.Unlock()
+
+	if err := uf.commit(stat); err != nil {
+		uf.abort()
+		return err
+	}
+	uf.removeState()
+	return nil
+}
+
+// abort removes the staged file of the session and forgets it
+func (us *uploadStore) abort(uf *uploadFile) {
+	uf.mu.Lock()
+	defer uf.mu.Unlock()
+
+	us.mu.Lock()
+	if us.files[uf.ID] == uf {
+		delete(us.files, uf.ID)
+	}
+	us.mu.Unlock()
+	uf.abort()
+}
+
+// writeChunk receives the chunks of a CopyFile without upload session,
+// the first chunk starts a new upload and the last one commits it.
+// done is true when target is replaced. A file of many chunks is only
+// committed when the last chunk has the md5 of the whole file.
+func (us *uploadStore) writeChunk(target string, myFile *MyFile, data []byte) (done bool, err error) {
+	id := "copy-" + StrMd5(target)
+	var uf *uploadFile
+	if myFile.Index > 0 {
+		if uf, err = us.lookup(id); err != nil {
+			return false, fmt.Errorf("chunk %d of %q has no upload started: %w", myFile.Index, filepath.Base(target), err)
+		}
+	} else if uf, err = us.begin(id, target, true); err != nil {
+		return false, err
+	}
+	if err = us.write(uf, myFile, data); err != nil {
+		return false, err
+	}
+	if myFile.Total != 0 && myFile.Index+1 != myFile.Total {
+		return false, nil
+	}
+	if myFile.Total > 1 && (myFile.Stat == nil || myFile.Stat.Md5 == "") {
+		us.abort(uf)
+		return false, fmt.Errorf("the last chunk of %q has no md5", filepath.Base(target))
+	}
+	if err = us.commit(uf, myFile.Stat); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// gcLoop removes uploads abandoned for longer than timeout
+func (us *uploadStore) gcLoop() {
+	tk := time.NewTicker(time.Minute)
+	defer tk.Stop()
+	for range tk.C {
+		us.gc()
+	}
+}
+
+func (us *uploadStore) gc() {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	for id, uf := range us.files {
+		if !uf.mu.TryLock() {
+			continue
+		}
+		if time.Since(uf.Updated) > us.timeout {
+			glog.Infoln("upload", uf.Target, "abandoned, remove", uf.TmpName)
+			uf.abort()
+			delete(us.files, id)
+		}
+		uf.mu.Unlock()
+	}
+}
+
+// cleanStaleUploads removes staged files left by a previous process
+func cleanStaleUploads(home string, timeout time.Duration) {
+	err := filepath.WalkDir(home, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !isUploadTmp(path) {
+			return nil
+		}
+		info, err := d.Info()
+		if err == nil && time.Since(info.ModTime()) > timeout {
+			glog.Infoln("remove stale upload file", path)
+			os.Remove(path)
+		}
+		return nil
+	})
+	if err != nil {
+		glog.Warningln("clean stale uploads failed:", err)
+	}
+}
@@ -0,0 +1,103 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUploadStore_writeChunk(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "a.txt")
+	require.NoError(t, os.WriteFile(target, []byte("old content"), 0644))
+
+	us := newUploadStore("", time.Minute)
+	stat := &FileStat{Size: 10, FileMode: 0640, Md5: StrMd5("helloworld")}
+
+	// a later chunk never starts an upload
+	_, err := us.writeChunk(target, &MyFile{Stat: stat, Total: 2, Index: 1, Pos: 5}, []byte("world"))
+	require.Error(t, err)
+
+	// the last chunk must have the md5 of the whole file
+	_, err = us.writeChunk(target, &MyFile{Stat: stat, Total: 2, Index: 0, Pos: 0}, []byte("hello"))
+	require.NoError(t, err)
+	_, err = us.writeChunk(target, &MyFile{Stat: &FileStat{Size: 10, FileMode: 0640}, Total: 2, Index: 1, Pos: 5}, []byte("world"))
+	require.Error(t, err)
+	matches, _ := filepath.Glob(filepath.Join(dir, uploadTmpPrefix+"*"))
+	require.Empty(t, matches)
+	_, err = us.writeChunk(target, &MyFile{Stat: stat, Total: 2, Index: 1, Pos: 5}, []byte("world"))
+	require.Error(t, err)
+
+	done, err := us.writeChunk(target, &MyFile{Stat: stat, Total: 2, Index: 0, Pos: 0}, []byte("hello"))
+	require.NoError(t, err)
+	require.False(t, done)
+
+	got, err := os.ReadFile(target)
+	require.NoError(t, err)
+	require.Equal(t, "old content", string(got))
+
+	done, err = us.writeChunk(target, &MyFile{Stat: stat, Total: 2, Index: 1, Pos: 5}, []byte("world"))
+	require.NoError(t, err)
+	require.True(t, done)
+
+	got, err = os.ReadFile(target)
+	require.NoError(t, err)
+	require.Equal(t, "helloworld", string(got))
+	info, err := os.Stat(target)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0640), info.Mode().Perm())
+
+	// abandoned upload is removed
+	_, err = us.writeChunk(target, &MyFile{Stat: stat, Total: 2, Index: 0, Pos: 0}, []byte("12345"))
+	require.NoError(t, err)
+	us.timeout = 0
+	us.gc()
+	matches, _ = filepath.Glob(filepath.Join(dir, uploadTmpPrefix+"*"))
+	require.Empty(t, matches)
+}
+
+func TestUploadStore_resume(t *testing.T) {
+	dir := t.TempDir()
+	stateDir := filepath.Join(dir, ".state")
+	target := filepath.Join(dir, "b.txt")
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	stat := &FileStat{Size: 10, FileMode: 0644, Md5: StrMd5("helloworld"), Mtime: mtime}
+	id := uploadID("default", "b.txt", stat)
+
+	us := newUploadStore(stateDir, time.Minute)
+	uf, err := us.begin(id, target, false)
+	require.NoError(t, err)
+	require.NoError(t, us.write(uf, &MyFile{Index: 1, Pos: 5}, []byte("world")))
+
+	// a new store, as after a restart, still has the chunk
+	us = newUploadStore(stateDir, time.Minute)
+	uf, err = us.begin(id, target, false)
+	require.NoError(t, err)
+	require.Equal(t, []int64{1}, uf.haveList())
+	require.NoError(t, us.write(uf, &MyFile{Index: 0, Pos: 0}, []byte("hello")))
+	require.NoError(t, us.commit(uf, stat))
+
+	got, err := os.ReadFile(target)
+	require.NoError(t, err)
+	require.Equal(t, "helloworld", string(got))
+	info, err := os.Stat(target)
+	require.NoError(t, err)
+	require.True(t, mtime.Equal(info.ModTime()))
+	matches, _ := filepath.Glob(filepath.Join(stateDir, "*"))
+	require.Empty(t, matches)
+}
+
+func TestUploadStore_commitChecksum(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "c.txt")
+	us := newUploadStore("", time.Minute)
+	stat := &FileStat{Size: 5, FileMode: 0644, Md5: StrMd5("world")}
+	done, err := us.writeChunk(target, &MyFile{Stat: stat, Total: 1}, []byte("hello"))
+	require.False(t, done)
+	require.True(t, isChecksumMismatch(err), err)
+	_, err = os.Stat(target)
+	require.True(t, os.IsNotExist(err))
+}
@@ -5,8 +5,10 @@ import (
 	"bytes"
 	"compress/gzip"
 	"crypto/md5"
+	"crypto/tls"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
@@ -40,9 +42,16 @@ func FileMd5(name string) string {
 	return hex.EncodeToString(h.Sum(nil))
 }
 
-func RpcDialHTTPPath(network, address, path string, timeout time.Duration) (*rpc.Client, error) {
+// RpcDialHTTPPath connects to an HTTP RPC server,
+// the connection uses tls when tlsConf is not nil
+func RpcDialHTTPPath(network, address, path string, timeout time.Duration, tlsConf *tls.Config) (*rpc.Client, error) {
 	var err error
-	conn, err := net.DialTimeout(network, address, timeout)
+	var conn net.Conn
+	if tlsConf == nil {
+		conn, err = net.DialTimeout(network, address, timeout)
+	} else {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: timeout}, network, address, tlsConf)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -79,12 +88,21 @@ func checkDir(dir string, mode os.FileMode) error {
 var copyMux sync.Mutex
 
 func copyFile(dest, src string) (err error) {
+	return copyFileSkip(dest, src, nil)
+}
+
+// copyFileSkip copies src to dest like copyFile, the files and dirs under src
+// for which skip returns true are not copied
+func copyFileSkip(dest, src string, skip func(name string, info os.FileInfo) bool) (err error) {
 	glog.V(2).Infof("copyFile [%s] -> [%s]", src, dest)
 	if glog.V(2) {
 		defer func() {
 			glog.Warningln("copyFile ", src, "->", dest, "err=", err)
 		}()
 	}
+	if info, err := os.Lstat(src); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		return copySymlink(dest, src)
+	}
 	f, err := os.Open(src)
 	if err != nil {
 		return err
@@ -104,7 +122,16 @@ func copyFile(dest, src string) (err error) {
 			}
 		}
 		err = filepath.Walk(src, func(fileName string, info os.FileInfo, err error) error {
-			if !info.IsDir() {
+			if err != nil {
+				return err
+			}
+			if skip != nil && fileName != src && skip(fileName, info) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !info.IsDir() && !isUploadTmp(fileName) {
 				rel, _ := filepath.Rel(src, fileName)
 
 				pathDest := filepath.Join(dest, rel)
@@ -153,8 +180,31 @@ func dataGzipEncode(data []byte) (out []byte) {
 	return buf.Bytes()
 }
 
-func dataGzipDecode(data []byte) (out []byte) {
-	gr, _ := gzip.NewReader(bytes.NewBuffer(data))
-	bs, _ := io.ReadAll(gr)
-	return bs
+func dataGzipDecode(data []byte) (out []byte, err error) {
+	gr, err := gzip.NewReader(bytes.NewBuffer(data))
+	if err != nil {
+		return nil, fmt.Errorf("gzip decode: %w", err)
+	}
+	defer gr.Close()
+	out, err = io.ReadAll(gr)
+	if err != nil {
+		return nil, fmt.Errorf("gzip decode: %w", err)
+	}
+	return out, nil
+}
+
+// copySymlink makes dest a link with the same target as src
+func copySymlink(dest, src string) error {
+	target, err := os.Readlink(src)
+	if err != nil {
+		return err
+	}
+	if old, err := os.Readlink(dest); err == nil && old == target {
+		return nil
+	}
+	if err = checkDir(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	os.RemoveAll(dest)
+	return os.Symlink(target, dest)
 }